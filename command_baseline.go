@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+type BaselineCommand struct {
+}
+
+func (c *BaselineCommand) Help() string {
+	helpText := `
+Usage: evedbtool baseline -at <migration id> [options] ...
+  Marks an existing database, installed without this tool, as up to date.
+  All base files, every migration of the sources before the one of the given
+  migration, and the migrations of its source up to and including it are
+  recorded as applied without running them.
+Options:
+  -at=<id>               The last migration already contained in the database.
+  -source=<name>         Only look for the migration in the named migration source.
+  -dryrun                Don't record anything, just print what would be marked.
+  -var name=value        Set a variable for the SQL files, can be repeated.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *BaselineCommand) Synopsis() string {
+	return "Marks a database installed without this tool as up to date"
+}
+
+func (c *BaselineCommand) Run(args []string) int {
+	var target string
+	var sourceName string
+	var dryrun bool
+
+	cmdFlags := flag.NewFlagSet("baseline", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
+	cmdFlags.StringVar(&target, "at", "", "The last migration already contained in the database.")
+	cmdFlags.StringVar(&sourceName, "source", "", "Only look for the migration in the named migration source.")
+	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't record anything, just print what would be marked.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if target == "" {
+		ui.Output(c.Help())
+		return 1
+	}
+
+	if err := Baseline(target, sourceName, dryrun); err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	return 0
+}
+
+// Record base files and migrations up to the target as applied on a database
+// that already contains them
+func Baseline(target string, sourceName string, dryrun bool) error {
+	tables := GetNumberOfTables()
+	log.Info("Number of tables in DB: ", tables)
+	if tables == 0 {
+		return errors.New("Database is empty, use 'evedbtool install' instead")
+	}
+
+	sources, err := SelectMigrationSources(sourceName)
+	if err != nil {
+		return err
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	index := -1
+	for i := range sources {
+		migrations, err := sources[i].Source(db).FindMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if m.Id == target {
+				index = i
+				break
+			}
+		}
+		if index >= 0 {
+			break
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("Unknown migration: %s", target)
+	}
+	source := &sources[index]
+
+	//Check the target can still be marked before anything is recorded
+	planned, _, err := source.Set().PlanMigration(db, "mysql", source.Source(db), migrate.Up, 0)
+	if err != nil {
+		return err
+	}
+	pending := false
+	for _, m := range planned {
+		if m.Id == target {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return fmt.Errorf("Migration %s is already applied", target)
+	}
+
+	//Base files are only identified by their id, their content is never read
+	files, err := FindBaseFiles()
+	if err != nil {
+		return err
+	}
+	var baseMigrations []*migrate.Migration
+	for _, file := range files {
+		baseMigrations = append(baseMigrations, BuildMigration(file, nil))
+	}
+	baseSet := migrate.MigrationSet{TableName: "base_migrations"}
+	baseSource := &migrate.MemoryMigrationSource{Migrations: baseMigrations}
+
+	entry := NewHistoryEntry("baseline", "up", source.Name, target)
+	marked := "Marked"
+	if dryrun {
+		marked = "Would mark"
+	}
+
+	n, err := skipMigrations(db, "baseline", "base", baseSet, baseSource, 0, "", dryrun)
+	if err != nil {
+		entry.Finish(err)
+		RecordHistory(db, entry)
+		return fmt.Errorf("Cannot mark base files as applied: %s", err)
+	}
+	ui.Output(fmt.Sprintf("%s %d base files as applied", marked, n))
+
+	//Sources are applied in order, so the ones before the target's are complete
+	for _, s := range sources[:index] {
+		n, err = skipMigrations(db, "baseline", s.Name, s.Set(), s.Source(db), 0, "", dryrun)
+		if err != nil {
+			entry.Finish(err)
+			RecordHistory(db, entry)
+			return fmt.Errorf("Cannot mark migrations of %s as applied: %s", s.Name, err)
+		}
+		ui.Output(fmt.Sprintf("%s %d migrations of %s as applied", marked, n, s.Name))
+	}
+
+	n, err = skipMigrations(db, "baseline", source.Name, source.Set(), source.Source(db), 0, target, dryrun)
+	if err != nil {
+		entry.Finish(err)
+		RecordHistory(db, entry)
+		return fmt.Errorf("Cannot mark migrations of %s as applied: %s", source.Name, err)
+	}
+	ui.Output(fmt.Sprintf("%s %d migrations of %s as applied", marked, n, source.Name))
+
+	if !dryrun {
+		entry.Finish(nil)
+		RecordHistory(db, entry)
+	}
+
+	return nil
+}
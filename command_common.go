@@ -1,46 +1,407 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	migrate "github.com/rubenv/sql-migrate"
-	"github.com/spf13/viper"
 )
 
-func ApplyMigrations(dir migrate.MigrationDirection, dryrun bool, limit int) error {
+// Options shared by the commands that apply migrations
+type ApplyOptions struct {
+	DryRun          bool
+	Limit           int
+	Source          string
+	AllowOutOfOrder bool
+	Validate        bool
+	VerifyRollback  bool
+	Release         string // Stop at the marker migration of this release
+	Command         string // Name of the command, as recorded in the history
+}
+
+func ApplyMigrations(dir migrate.MigrationDirection, opts ApplyOptions) error {
 
 	db := getDB()
+	defer db.Close()
 	dialect := "mysql"
 
-	source := migrate.FileMigrationSource{
-		Dir: viper.GetString("migrations-dir"),
+	//A release only moves the source its marker migration belongs to
+	var target string
+	if opts.Release != "" {
+		release, err := FindRelease(opts.Release)
+		if err != nil {
+			return err
+		}
+		if opts.Source != "" && opts.Source != release.Source {
+			return fmt.Errorf("Release %s belongs to source %s", release.Name, release.Source)
+		}
+		opts.Source = release.Source
+		target = release.Migration
+	}
+
+	sources, err := SelectMigrationSources(opts.Source)
+	if err != nil {
+		return err
+	}
+
+	if target != "" {
+		if err := checkMigrationExists(sources[0].Source(db), target); err != nil {
+			return fmt.Errorf("Release %s: %s", opts.Release, err)
+		}
+	}
+
+	//Sources are applied in order, and reverted in the opposite order
+	if dir == migrate.Down {
+		for i, j := 0, len(sources)-1; i < j; i, j = i+1, j-1 {
+			sources[i], sources[j] = sources[j], sources[i]
+		}
+	}
+
+	//Check every source before applying anything, so a gap doesn't stop up half way
+	if dir == migrate.Up && !opts.AllowOutOfOrder {
+		var gaps []string
+		for _, s := range sources {
+			migrations, err := FindOutOfOrderMigrations(db, s)
+			if err != nil {
+				return fmt.Errorf("Cannot check migration order for source %s: %s", s.Name, err)
+			}
+			for _, m := range migrations {
+				gaps = append(gaps, fmt.Sprintf("  %s (source %s)", m.Id, s.Name))
+			}
+		}
+		if len(gaps) > 0 {
+			message := "Unapplied migrations older than the newest applied one of their source:\n" + strings.Join(gaps, "\n")
+			//Dry runs and validation apply nothing for real, they only warn
+			if !opts.DryRun && !opts.Validate {
+				return fmt.Errorf("%s\nRun with -allow-out-of-order to apply them", message)
+			}
+			ui.Warn(message + "\nApplying them needs -allow-out-of-order")
+		}
 	}
 
-	if dryrun {
-		migrations, _, err := migrate.PlanMigration(db, dialect, source, dir, limit)
+	remaining := opts.Limit
+	total := 0
+	var planned []*migrate.PlannedMigration
+	for _, s := range sources {
+		if opts.Limit > 0 && remaining == 0 {
+			break
+		}
+
+		set := s.Set()
+		src := s.Source(db)
+		migrations, dbMap, err := set.PlanMigration(db, dialect, src, dir, remaining)
 		if err != nil {
-			return fmt.Errorf("Cannot plan migration: %s", err)
+			return fmt.Errorf("Cannot plan migration for source %s: %s", s.Name, err)
+		}
+		if target != "" {
+			migrations = limitToTarget(migrations, dir, target)
 		}
+		//sql-migrate plans catch-up migrations on top of max, so they count against the limit here
+		if opts.Limit > 0 && len(migrations) > remaining {
+			migrations = migrations[:remaining]
+		}
+		for i := range migrations {
+			if migrations[i], err = expandPlannedMigration(migrations[i], dir); err != nil {
+				return err
+			}
+		}
+
+		if opts.Validate {
+			planned = append(planned, migrations...)
+		} else if opts.DryRun {
+			for _, m := range migrations {
+				PrintMigration(m, dir)
+			}
+		} else {
+			for _, m := range migrations {
+				entry := NewHistoryEntry(opts.Command, directionName(dir), s.Name, m.Id)
+				err := applyPlannedMigration(dbMap, dir, m)
+				entry.Finish(err)
+				RecordHistory(db, entry)
+				if err != nil {
+					return fmt.Errorf("Migration failed for source %s: %s", s.Name, err)
+				}
+				total++
+
+				if dir == migrate.Up {
+					if err := verifyMigration(db, dbMap, src, m, opts.VerifyRollback, opts.Command, s.Name); err != nil {
+						return err
+					}
+				}
+			}
 
-		for _, m := range migrations {
-			PrintMigration(m, dir)
+			if len(sources) > 1 && len(migrations) > 0 {
+				ui.Output(fmt.Sprintf("Source %s: applied %d migrations", s.Name, len(migrations)))
+			}
 		}
-	} else {
-		n, err := migrate.ExecMax(db, dialect, source, dir, limit)
+		if opts.Limit > 0 {
+			remaining -= len(migrations)
+		}
+	}
+
+	//Repeatable migrations always run after all versioned migrations have been applied
+	if dir == migrate.Up && opts.Source == "" && (opts.Limit == 0 || remaining > 0) {
+		repeatables, err := PlanRepeatableMigrations(db)
 		if err != nil {
-			return fmt.Errorf("Migration failed: %s", err)
+			return fmt.Errorf("Cannot plan repeatable migrations: %s", err)
 		}
 
-		if n == 1 {
+		for _, m := range repeatables {
+			if opts.Validate {
+				planned = append(planned, &migrate.PlannedMigration{
+					Migration: &migrate.Migration{Id: m.Id, Up: m.Statements},
+					Queries:   m.Statements,
+				})
+			} else if opts.DryRun {
+				ui.Output(fmt.Sprintf("==> Would apply repeatable migration %s", m.Id))
+				for _, q := range m.Statements {
+					ui.Output(q)
+				}
+			} else {
+				entry := NewHistoryEntry(opts.Command, "up", "repeatable", m.Id)
+				err := applyRepeatableMigration(db, m)
+				entry.Finish(err)
+				RecordHistory(db, entry)
+				if err != nil {
+					return fmt.Errorf("Repeatable migration %s failed: %s", m.Id, err)
+				}
+				total++
+			}
+		}
+	}
+
+	if opts.Validate {
+		return ValidateMigrations(db, planned)
+	}
+
+	if !opts.DryRun {
+		if total == 1 {
 			ui.Output("Applied 1 migration")
 		} else {
-			ui.Output(fmt.Sprintf("Applied %d migrations", n))
+			ui.Output(fmt.Sprintf("Applied %d migrations", total))
 		}
 	}
 
 	return nil
 }
 
+// Apply a planned migration. Only migrations that change nothing but data in a
+// transaction are retried as a whole on transient errors, for any other migration
+// a failed attempt may have left changes behind, so only connecting is retried.
+func applyPlannedMigration(dbMap *gorp.DbMap, dir migrate.MigrationDirection, m *migrate.PlannedMigration) error {
+	if !m.DisableTransaction && IsTransactional(m.Queries) {
+		return GetRetryPolicy().DoVerified("Migration "+m.Id, func() error {
+			return execPlannedMigration(dbMap, dir, m)
+		}, func() (bool, error) {
+			//The migration record is written in the same transaction as the statements
+			record, err := dbMap.Get(migrate.MigrationRecord{}, m.Id)
+			if err != nil {
+				return false, err
+			}
+			return (record != nil) == (dir == migrate.Up), nil
+		})
+	}
+	if err := GetRetryPolicy().DoIdempotent("Connecting for migration "+m.Id, dbMap.Db.Ping); err != nil {
+		return &migrate.TxError{Migration: m.Migration, Err: err}
+	}
+	return execPlannedMigration(dbMap, dir, m)
+}
+
+// Apply a repeatable migration, retried the same way as applyPlannedMigration
+func applyRepeatableMigration(db *sql.DB, m *RepeatableMigration) error {
+	if IsTransactional(m.Statements) {
+		return GetRetryPolicy().DoVerified("Repeatable migration "+m.Id, func() error {
+			return ApplyRepeatableMigration(db, m)
+		}, func() (bool, error) {
+			checksums, _, err := GetRepeatableRecords(db)
+			return checksums[m.Id] == m.Checksum, err
+		})
+	}
+	if err := GetRetryPolicy().DoIdempotent("Connecting for repeatable migration "+m.Id, db.Ping); err != nil {
+		return err
+	}
+	return ApplyRepeatableMigration(db, m)
+}
+
+// Apply a single planned migration and update the tracking table, the same way sql-migrate does
+func execPlannedMigration(dbMap *gorp.DbMap, dir migrate.MigrationDirection, m *migrate.PlannedMigration) error {
+	var executor migrate.SqlExecutor
+	var tx *gorp.Transaction
+	var err error
+
+	if m.DisableTransaction {
+		executor = dbMap
+	} else {
+		tx, err = dbMap.Begin()
+		if err != nil {
+			return &migrate.TxError{Migration: m.Migration, Err: err}
+		}
+		executor = tx
+	}
+
+	fail := func(err error) error {
+		if tx != nil {
+			_ = tx.Rollback()
+		}
+		return &migrate.TxError{Migration: m.Migration, Err: err}
+	}
+
+	for _, stmt := range m.Queries {
+		stmt = strings.TrimSuffix(stmt, "\n")
+		stmt = strings.TrimSuffix(stmt, " ")
+		stmt = strings.TrimSuffix(stmt, ";")
+		log.Trace("QUERY: ", stmt)
+		if _, err := executor.Exec(stmt); err != nil {
+			return fail(err)
+		}
+	}
+
+	switch dir {
+	case migrate.Up:
+		err = executor.Insert(&migrate.MigrationRecord{
+			Id:        m.Id,
+			AppliedAt: time.Now(),
+		})
+	case migrate.Down:
+		_, err = executor.Delete(&migrate.MigrationRecord{
+			Id: m.Id,
+		})
+	default:
+		panic("Not reached")
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return &migrate.TxError{Migration: m.Migration, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Run the Verify assertions of a freshly applied migration. When an assertion fails
+// the Down section can be run to revert the migration.
+func verifyMigration(db *sql.DB, dbMap *gorp.DbMap, src *FileSource, m *migrate.PlannedMigration, rollback bool, command string, sourceName string) error {
+	checks, err := ExpandStatements(src.Verifications(m.Id))
+	if err != nil {
+		return fmt.Errorf("Verification of migration %s: %s", m.Id, err)
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+
+	entry := NewHistoryEntry(command, "verify", sourceName, m.Id)
+	failed := runVerifications(db, checks)
+	entry.Finish(failed)
+	RecordHistory(db, entry)
+	if failed == nil {
+		log.Info("Verified migration ", m.Id, " (", len(checks), " checks)")
+		return nil
+	}
+
+	if !rollback {
+		return fmt.Errorf("Verification of migration %s failed: %s\nRun 'evedbtool down' to revert it", m.Id, failed)
+	}
+
+	log.Warn("Verification of migration ", m.Id, " failed, running its Down section")
+	down, err := expandPlannedMigration(&migrate.PlannedMigration{
+		Migration:          m.Migration,
+		Queries:            m.Down,
+		DisableTransaction: m.DisableTransactionDown,
+	}, migrate.Down)
+	if err != nil {
+		return fmt.Errorf("Verification of migration %s failed: %s\nCannot revert it: %s", m.Id, failed, err)
+	}
+	entry = NewHistoryEntry(command, "down", sourceName, m.Id)
+	err = applyPlannedMigration(dbMap, migrate.Down, down)
+	entry.Finish(err)
+	RecordHistory(db, entry)
+	if err != nil {
+		return fmt.Errorf("Verification of migration %s failed: %s\nReverting it failed as well: %s", m.Id, failed, err)
+	}
+
+	return fmt.Errorf("Verification of migration %s failed: %s\nThe migration has been reverted", m.Id, failed)
+}
+
+// Run assertion queries, each has to return a single true (non-zero) value
+func runVerifications(db *sql.DB, checks []string) error {
+	for _, check := range checks {
+		var result sql.NullString
+		log.Trace("QUERY: ", check)
+		if err := db.QueryRow(check).Scan(&result); err != nil {
+			return fmt.Errorf("check %q could not be run: %s", summarizeStatement(check), err)
+		}
+		if !result.Valid || result.String == "" || result.String == "0" || strings.EqualFold(result.String, "false") {
+			return fmt.Errorf("check %q returned %q", summarizeStatement(check), result.String)
+		}
+	}
+	return nil
+}
+
+// Record a planned migration as applied without running its statements
+func skipPlannedMigration(dbMap *gorp.DbMap, m *migrate.PlannedMigration) error {
+	err := dbMap.Insert(&migrate.MigrationRecord{
+		Id:        m.Id,
+		AppliedAt: time.Now(),
+	})
+	if err != nil {
+		return &migrate.TxError{Migration: m.Migration, Err: err}
+	}
+	return nil
+}
+
+func directionName(dir migrate.MigrationDirection) string {
+	if dir == migrate.Down {
+		return "down"
+	}
+	return "up"
+}
+
+// Find the unapplied migrations of a source that sort before the newest applied one.
+// These typically appear after merging branches and would otherwise be applied silently.
+func FindOutOfOrderMigrations(db *sql.DB, source SourceConfig) ([]*migrate.Migration, error) {
+	migrations, err := source.Source(db).FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := source.Set().GetMigrationRecords(db, "mysql")
+	if err != nil {
+		return nil, err
+	}
+
+	return outOfOrderMigrations(migrations, records), nil
+}
+
+func outOfOrderMigrations(migrations []*migrate.Migration, records []*migrate.MigrationRecord) []*migrate.Migration {
+	applied := make(map[string]bool)
+	var newest *migrate.Migration
+	for _, r := range records {
+		applied[r.Id] = true
+		m := &migrate.Migration{Id: r.Id}
+		if newest == nil || newest.Less(m) {
+			newest = m
+		}
+	}
+
+	var gaps []*migrate.Migration
+	if newest == nil {
+		return gaps
+	}
+	for _, m := range migrations {
+		if !applied[m.Id] && m.Less(newest) {
+			gaps = append(gaps, m)
+		}
+	}
+	return gaps
+}
+
 func PrintMigration(m *migrate.PlannedMigration, dir migrate.MigrationDirection) {
 	if dir == migrate.Up {
 		ui.Output(fmt.Sprintf("==> Would apply migration %s (up)", m.Id))
@@ -17,6 +17,10 @@ Usage: evedbtool down [options] ...
 Options:
   -limit=1               Limit the number of migrations (0 = unlimited).
   -dryrun                Don't apply migrations, just print them.
+  -validate              Run the migrations against an empty copy of the schema instead.
+  -source=<name>         Only use the named migration source.
+  -to-release=<name>     Undo the migrations newer than the marker of this release (see releases.yaml).
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -26,21 +30,31 @@ func (c *DownCommand) Synopsis() string {
 }
 
 func (c *DownCommand) Run(args []string) int {
-	var limit int
-	var dryrun bool
-
-	migrate.SetTable("migrations")
+	opts := ApplyOptions{Command: "down"}
 
 	cmdFlags := flag.NewFlagSet("down", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
-	cmdFlags.IntVar(&limit, "limit", 1, "Max number of migrations to apply.")
-	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
+	cmdFlags.IntVar(&opts.Limit, "limit", 1, "Max number of migrations to apply.")
+	cmdFlags.BoolVar(&opts.DryRun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.BoolVar(&opts.Validate, "validate", false, "Run the migrations against an empty copy of the schema instead.")
+	cmdFlags.StringVar(&opts.Source, "source", "", "Only use the named migration source.")
+	cmdFlags.StringVar(&opts.Release, "to-release", "", "Undo the migrations newer than the marker of this release.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	err := ApplyMigrations(migrate.Down, dryrun, limit)
+	//Going back to a release undoes everything after it, unless limited explicitly
+	if opts.Release != "" {
+		limited := false
+		cmdFlags.Visit(func(f *flag.Flag) { limited = limited || f.Name == "limit" })
+		if !limited {
+			opts.Limit = 0
+		}
+	}
+
+	err := ApplyMigrations(migrate.Down, opts)
 	if err != nil {
 		ui.Error(err.Error())
 		return 1
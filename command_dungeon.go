@@ -188,7 +188,10 @@ func (c *DungeonImportCommand) Run(args []string) int {
 			log.Error("Error reading file: ", err)
 			return 1
 		} else {
-			ImportDungeon(data, overwrite)
+			if err := ImportDungeon(data, overwrite); err != nil {
+				log.Error(err)
+				return 1
+			}
 			log.Info("Successfully imported dungeon!")
 		}
 	} else {
@@ -236,7 +239,10 @@ func (c *DungeonApplyCommand) Run(args []string) int {
 					log.Error("Error reading file: ", err)
 					return 1
 				} else {
-					ImportDungeon(data, overwrite)
+					if err := ImportDungeon(data, overwrite); err != nil {
+						log.Error(item.Name(), ": ", err)
+						continue
+					}
 					successCount++
 				}
 			}
@@ -372,7 +378,10 @@ func (c *DungeonNewCommand) Run(args []string) int {
 			fmt.Println(string(data))
 			return 0
 		} else {
-			ImportDungeon(data, false)
+			if err := ImportDungeon(data, false); err != nil {
+				log.Error(err)
+				return 1
+			}
 		}
 	}
 
@@ -488,9 +497,11 @@ func (c *DungeonDeleteCommand) Run(args []string) int {
 		return 1
 	}
 
-	if DeleteDungeon(dungeonID) == 0 {
-		log.Info("Successfully deleted the dungeon.")
+	if err := DeleteDungeon(dungeonID); err != nil {
+		log.Error(err)
+		return 1
 	}
+	log.Info("Successfully deleted the dungeon.")
 
 	return 0
 }
@@ -560,10 +571,13 @@ func (c *DungeonAddRoomCommand) Run(args []string) int {
 			fmt.Println(string(data))
 			return 0
 		} else {
-			if DeleteDungeon(dungeonID) == 0 {
-				ImportDungeon(data, false)
-			} else {
-				log.Error("Error deleting existing dungeon, not importing updated dungeon.")
+			if err := DeleteDungeon(dungeonID); err != nil {
+				log.Error("Error deleting existing dungeon, not importing updated dungeon: ", err)
+				return 1
+			}
+			if err := ImportDungeon(data, false); err != nil {
+				log.Error(err)
+				return 1
 			}
 		}
 	}
@@ -634,10 +648,13 @@ func (c *DungeonRemoveRoomCommand) Run(args []string) int {
 			fmt.Println(string(data))
 			return 0
 		} else {
-			if DeleteDungeon(dungeonID) == 0 {
-				ImportDungeon(data, false)
-			} else {
-				log.Error("Error deleting existing dungeon, not importing updated dungeon.")
+			if err := DeleteDungeon(dungeonID); err != nil {
+				log.Error("Error deleting existing dungeon, not importing updated dungeon: ", err)
+				return 1
+			}
+			if err := ImportDungeon(data, false); err != nil {
+				log.Error(err)
+				return 1
 			}
 		}
 	}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HistoryCommand struct {
+}
+
+func (c *HistoryCommand) Help() string {
+	helpText := `
+Usage: evedbtool history [options] ...
+  Show the audit history of changes made to the database by this tool.
+Options:
+  -since=<YYYY-MM-DD>    Only show entries from this date (UTC) on.
+  -until=<YYYY-MM-DD>    Only show entries before this date (UTC).
+  -command=<name>        Only show entries of this command (up, down, redo, skip, install, seed, dungeon, ...).
+  -migration=<id>        Only show entries whose migration id contains this text.
+  -source=<name>         Only show entries of this migration source.
+  -limit=50              Limit the number of entries (0 = unlimited).
+  -json                  Print the entries as JSON.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *HistoryCommand) Synopsis() string {
+	return "Show the audit history of database changes"
+}
+
+func (c *HistoryCommand) Run(args []string) int {
+	var filter HistoryFilter
+	var since string
+	var until string
+	var asJSON bool
+
+	cmdFlags := flag.NewFlagSet("history", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.StringVar(&since, "since", "", "Only show entries from this date (UTC) on.")
+	cmdFlags.StringVar(&until, "until", "", "Only show entries before this date (UTC).")
+	cmdFlags.StringVar(&filter.Command, "command", "", "Only show entries of this command.")
+	cmdFlags.StringVar(&filter.MigrationID, "migration", "", "Only show entries whose migration id contains this text.")
+	cmdFlags.StringVar(&filter.Source, "source", "", "Only show entries of this migration source.")
+	cmdFlags.IntVar(&filter.Limit, "limit", 50, "Limit the number of entries (0 = unlimited).")
+	cmdFlags.BoolVar(&asJSON, "json", false, "Print the entries as JSON.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	var err error
+	if since != "" {
+		if filter.Since, err = time.ParseInLocation("2006-01-02", since, time.UTC); err != nil {
+			ui.Error(fmt.Sprintf("Invalid -since date: %s", since))
+			return 1
+		}
+	}
+	if until != "" {
+		if filter.Until, err = time.ParseInLocation("2006-01-02", until, time.UTC); err != nil {
+			ui.Error(fmt.Sprintf("Invalid -until date: %s", until))
+			return 1
+		}
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	entries, err := QueryHistory(db, filter)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	if asJSON {
+		if err := PrintJSON(entries); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	var rows [][]string
+	for _, e := range entries {
+		result := "ok"
+		if !e.Success {
+			result = "failed: " + e.Message
+		}
+		rows = append(rows, []string{
+			e.StartedAt.Format("2006-01-02 15:04:05"),
+			e.Command,
+			e.Direction,
+			e.Source,
+			e.MigrationID,
+			e.User + "@" + e.Host,
+			e.Version,
+			strconv.FormatInt(e.DurationMs, 10) + "ms",
+			result,
+		})
+	}
+	PrintTable([]string{"Started", "Command", "Direction", "Source", "Migration", "By", "Version", "Duration", "Result"}, rows)
+
+	return 0
+}
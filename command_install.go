@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
 )
 
 type InstallCommand struct {
@@ -17,6 +18,9 @@ Usage: evedbtool install [options] ...
 Options:
   -limit=0               Limit the number of migrations (0 = unlimited).
   -dryrun                Don't apply migrations, just print them.
+  -allow-out-of-order    Apply migrations older than the newest applied one.
+  -verify-rollback       Run the Down section of a migration whose Verify checks fail.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -26,19 +30,21 @@ func (c *InstallCommand) Synopsis() string {
 }
 
 func (c *InstallCommand) Run(args []string) int {
-	var limit int
-	var dryrun bool
+	opts := ApplyOptions{Command: "install"}
 
 	cmdFlags := flag.NewFlagSet("up", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
-	cmdFlags.IntVar(&limit, "limit", 0, "Max number of migrations to apply.")
-	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
+	cmdFlags.IntVar(&opts.Limit, "limit", 0, "Max number of migrations to apply.")
+	cmdFlags.BoolVar(&opts.DryRun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.BoolVar(&opts.AllowOutOfOrder, "allow-out-of-order", false, "Apply migrations older than the newest applied one.")
+	cmdFlags.BoolVar(&opts.VerifyRollback, "verify-rollback", viper.GetBool("verify-rollback"), "Run the Down section of a migration whose Verify checks fail.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if !dryrun {
+	if !opts.DryRun {
 		tables := GetNumberOfTables()
 		log.Info("Number of tables in DB: ", tables)
 		if tables == 0 {
@@ -50,8 +56,7 @@ func (c *InstallCommand) Run(args []string) int {
 	} else {
 		log.Info("Dry run, not installing base.")
 	}
-	migrate.SetTable("migrations")
-	err := ApplyMigrations(migrate.Up, dryrun, limit)
+	err := ApplyMigrations(migrate.Up, opts)
 	if err != nil {
 		ui.Error(err.Error())
 		return 1
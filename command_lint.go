@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+const downCommand = "-- +migrate Down"
+
+type LintCommand struct {
+}
+
+func (c *LintCommand) Help() string {
+	helpText := `
+Usage: evedbtool lint [options] ...
+  Check the migration files for parse errors and empty Down sections.
+Options:
+  -source=<name>         Only check the named migration source.
+  -fix                   Generate the missing Down sections from the Up statements.
+                         Statements that can't be reversed are flagged with a TODO comment.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *LintCommand) Synopsis() string {
+	return "Check the migration files for problems"
+}
+
+func (c *LintCommand) Run(args []string) int {
+	var sourceName string
+	var fix bool
+
+	cmdFlags := flag.NewFlagSet("lint", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.StringVar(&sourceName, "source", "", "Only check the named migration source.")
+	cmdFlags.BoolVar(&fix, "fix", false, "Generate the missing Down sections from the Up statements.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	sources, err := SelectMigrationSources(sourceName)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	var rows [][]string
+	for _, source := range sources {
+		problems, err := LintMigrations(source.Dir, fix)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		rows = append(rows, problems...)
+	}
+
+	if len(rows) == 0 {
+		ui.Output("No problems found")
+		return 0
+	}
+
+	PrintTable([]string{"File", "Problem"}, rows)
+
+	for _, row := range rows {
+		if !strings.HasPrefix(row[1], "fixed") {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Check every migration file of a directory, returning a (file, problem) row for each
+// problem found. With fix, empty Down sections are generated from the Up statements.
+func LintMigrations(dir string, fix bool) ([][]string, error) {
+	items, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var problems [][]string
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".sql") {
+			continue
+		}
+
+		file := filepath.Join(dir, item.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		content, _, err := extractVerifySection(string(data))
+		if err != nil {
+			problems = append(problems, []string{file, err.Error()})
+			continue
+		}
+
+		migration, err := migrate.ParseMigration(item.Name(), bytes.NewReader([]byte(content)))
+		if err != nil {
+			problems = append(problems, []string{file, err.Error()})
+			continue
+		}
+
+		if len(migration.Up) == 0 {
+			problems = append(problems, []string{file, "Up section is empty"})
+			continue
+		}
+		if len(migration.Down) > 0 || migration.DisableTransactionDown {
+			continue
+		}
+
+		if !fix {
+			problems = append(problems, []string{file, "Down section is empty"})
+			continue
+		}
+
+		lines, unreversible := BuildDownSection(migration.Up)
+		if err := ioutil.WriteFile(file, []byte(insertDownSection(string(data), lines)), item.Mode()); err != nil {
+			return nil, fmt.Errorf("Error writing %s: %s", file, err)
+		}
+		log.Info("Generated Down section of ", file)
+
+		if unreversible > 0 {
+			problems = append(problems, []string{file, fmt.Sprintf("Down section generated, %d statements need to be reversed by hand", unreversible)})
+		} else {
+			problems = append(problems, []string{file, "fixed: Down section generated"})
+		}
+	}
+
+	return problems, nil
+}
+
+// Add lines to the Down section of a migration, creating the section if it's missing
+func insertDownSection(content string, lines []string) string {
+	fileLines := strings.Split(content, "\n")
+	for i, line := range fileLines {
+		if strings.HasPrefix(line, downCommand) {
+			result := append([]string{}, fileLines[:i+1]...)
+			result = append(result, lines...)
+			return strings.Join(append(result, fileLines[i+1:]...), "\n")
+		}
+	}
+
+	content = strings.TrimRight(content, "\n")
+	return content + "\n\n" + downCommand + "\n" + strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Map CLI root command
+type MapCommand struct {
+}
+
+func (c *MapCommand) Help() string {
+	helpText := `
+Usage: evedbtool map [options] ...
+  Inspect the EVEmu map.
+Subcommands:
+  regions                List the regions that can be seeded.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MapCommand) Synopsis() string {
+	return "Inspects the EVEmu map."
+}
+
+func (c *MapCommand) Run(args []string) int {
+	fmt.Println(c.Help())
+
+	return 0
+}
+
+// List regions
+type MapRegionsCommand struct {
+}
+
+func (c *MapRegionsCommand) Help() string {
+	helpText := `
+Usage: evedbtool map regions [options] ...
+  Lists the regions that can be seeded, with their number of solar systems and stations.
+  Constellation and solar system names can be seeded as well.
+Options:
+  -json                  Print the regions as JSON.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MapRegionsCommand) Synopsis() string {
+	return "Lists the regions that can be seeded."
+}
+
+func (c *MapRegionsCommand) Run(args []string) int {
+	var asJSON bool
+
+	cmdFlags := flag.NewFlagSet("regions", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.BoolVar(&asJSON, "json", false, "Print the regions as JSON.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	regions, err := ListRegions(db)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Cannot list regions: %s", err))
+		return 1
+	}
+
+	if asJSON {
+		if err := PrintJSON(regions); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	var rows [][]string
+	for _, r := range regions {
+		rows = append(rows, []string{strconv.Itoa(r.ID), r.Name, strconv.Itoa(r.Systems), strconv.Itoa(r.Stations)})
+	}
+	PrintTable([]string{"Region ID", "Region Name", "Systems", "Stations"}, rows)
+
+	return 0
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Market CLI root command
+type MarketCommand struct {
+}
+
+func (c *MarketCommand) Help() string {
+	helpText := `
+Usage: evedbtool market [options] ...
+  Inspect and clean up the EVEmu market.
+Subcommands:
+  orders                 List market orders.
+  depth                  Show the sell and buy side of the market per type.
+  purge                  Delete market orders matching filters.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MarketCommand) Synopsis() string {
+	return "Inspects and cleans up the EVEmu market."
+}
+
+func (c *MarketCommand) Run(args []string) int {
+	fmt.Println(c.Help())
+
+	return 0
+}
+
+// Options shared by the market subcommands
+const orderFilterHelp = `
+  -region=<area>         Only orders in a region, constellation or solar system.
+  -station=<id>          Only orders at a station.
+  -type=<id|name>        Only orders of a type.
+  -owner=<id>            Only orders of an owner.
+  -orders=all            Which orders: all, sell or buy.
+  -seeded                Only orders inserted by seed migrations.
+  -expired               Only orders past their duration.
+  -zero-volume           Only orders without remaining volume.`
+
+func orderFilterFlags(cmdFlags *flag.FlagSet, filter *OrderFilter) {
+	cmdFlags.StringVar(&filter.Area, "region", "", "Only orders in a region, constellation or solar system.")
+	cmdFlags.IntVar(&filter.StationID, "station", 0, "Only orders at a station.")
+	cmdFlags.StringVar(&filter.Type, "type", "", "Only orders of a type.")
+	cmdFlags.IntVar(&filter.OwnerID, "owner", 0, "Only orders of an owner.")
+	cmdFlags.StringVar(&filter.Orders, "orders", "all", "Which orders: all, sell or buy.")
+	cmdFlags.BoolVar(&filter.Seeded, "seeded", false, "Only orders inserted by seed migrations.")
+	cmdFlags.BoolVar(&filter.Expired, "expired", false, "Only orders past their duration.")
+	cmdFlags.BoolVar(&filter.ZeroVolume, "zero-volume", false, "Only orders without remaining volume.")
+}
+
+// List market orders
+type MarketOrdersCommand struct {
+}
+
+func (c *MarketOrdersCommand) Help() string {
+	helpText := `
+Usage: evedbtool market orders [options] ...
+  Lists market orders matching the filters, with the seed migration that inserted them.
+Options:` + orderFilterHelp + `
+  -limit=100             Limit the number of orders (0 = unlimited).
+  -json                  Print the orders as JSON.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MarketOrdersCommand) Synopsis() string {
+	return "Lists market orders."
+}
+
+func (c *MarketOrdersCommand) Run(args []string) int {
+	var filter OrderFilter
+	var asJSON bool
+
+	cmdFlags := flag.NewFlagSet("orders", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	orderFilterFlags(cmdFlags, &filter)
+	cmdFlags.IntVar(&filter.Limit, "limit", 100, "Limit the number of orders (0 = unlimited).")
+	cmdFlags.BoolVar(&asJSON, "json", false, "Print the orders as JSON.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	orders, err := ListOrders(db, filter)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Cannot list orders: %s", err))
+		return 1
+	}
+
+	if asJSON {
+		if err := PrintJSON(orders); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	var rows [][]string
+	for _, o := range orders {
+		side := "sell"
+		if o.Bid {
+			side = "buy"
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(o.OrderID),
+			o.TypeName,
+			o.StationName,
+			strconv.Itoa(o.OwnerID),
+			side,
+			strconv.FormatFloat(o.Price, 'f', 2, 64),
+			fmt.Sprintf("%d/%d", o.VolRemaining, o.VolEntered),
+			o.Issued.Format("2006-01-02 15:04"),
+			strconv.Itoa(o.Duration),
+			o.SeedID,
+		})
+	}
+	PrintTable([]string{"Order ID", "Type", "Station", "Owner", "Side", "Price", "Volume", "Issued", "Days", "Seed"}, rows)
+
+	return 0
+}
+
+// Show the market depth per type
+type MarketDepthCommand struct {
+}
+
+func (c *MarketDepthCommand) Help() string {
+	helpText := `
+Usage: evedbtool market depth [options] ...
+  Shows the number of orders, the volume and the best price of the sell and buy side
+  of the market per type, for the orders matching the filters.
+Options:` + orderFilterHelp + `
+  -limit=100             Limit the number of types (0 = unlimited).
+  -json                  Print the depth as JSON.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MarketDepthCommand) Synopsis() string {
+	return "Shows the market depth per type."
+}
+
+func (c *MarketDepthCommand) Run(args []string) int {
+	var filter OrderFilter
+	var asJSON bool
+
+	cmdFlags := flag.NewFlagSet("depth", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	orderFilterFlags(cmdFlags, &filter)
+	cmdFlags.IntVar(&filter.Limit, "limit", 100, "Limit the number of types (0 = unlimited).")
+	cmdFlags.BoolVar(&asJSON, "json", false, "Print the depth as JSON.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	depth, err := MarketDepth(db, filter)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Cannot get the market depth: %s", err))
+		return 1
+	}
+
+	if asJSON {
+		if err := PrintJSON(depth); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		return 0
+	}
+
+	var rows [][]string
+	for _, d := range depth {
+		rows = append(rows, []string{
+			strconv.Itoa(d.TypeID),
+			d.TypeName,
+			strconv.Itoa(d.SellOrders),
+			strconv.FormatInt(d.SellVolume, 10),
+			strconv.FormatFloat(d.MinSell, 'f', 2, 64),
+			strconv.Itoa(d.BuyOrders),
+			strconv.FormatInt(d.BuyVolume, 10),
+			strconv.FormatFloat(d.MaxBuy, 'f', 2, 64),
+		})
+	}
+	PrintTable([]string{"Type ID", "Type", "Sell orders", "Sell volume", "Min sell", "Buy orders", "Buy volume", "Max buy"}, rows)
+
+	return 0
+}
+
+// Delete market orders
+type MarketPurgeCommand struct {
+}
+
+func (c *MarketPurgeCommand) Help() string {
+	helpText := `
+Usage: evedbtool market purge [options] ...
+  Deletes the market orders matching the filters, at least one filter besides -orders
+  is needed.
+  Purged seeded orders are no longer tracked, so seed watch doesn't recreate them.
+Options:` + orderFilterHelp + `
+  -dryrun                Don't delete the orders, just count them.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *MarketPurgeCommand) Synopsis() string {
+	return "Deletes market orders matching filters."
+}
+
+func (c *MarketPurgeCommand) Run(args []string) int {
+	var filter OrderFilter
+	var dryrun bool
+
+	cmdFlags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	orderFilterFlags(cmdFlags, &filter)
+	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't delete the orders, just count them.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if filter.IsEmpty() {
+		ui.Error("Refusing to purge the whole market, use at least one filter besides -orders")
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	if dryrun {
+		n, err := PurgeOrders(db, filter, true)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		ui.Output(fmt.Sprintf("Would delete %d orders", n))
+		return 0
+	}
+
+	entry := NewHistoryEntry("market purge", "down", "market", "")
+	n, err := PurgeOrders(db, filter, false)
+	entry.Finish(err)
+	if err != nil {
+		RecordHistory(db, entry)
+		ui.Error(fmt.Sprintf("Cannot purge orders: %s", err))
+		return 1
+	}
+	entry.Message = fmt.Sprintf("Deleted %d orders", n)
+	RecordHistory(db, entry)
+	ui.Output(entry.Message)
+
+	return 0
+}
@@ -4,24 +4,39 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 	"text/template"
 	"time"
-
-	migrate "github.com/rubenv/sql-migrate"
-	"github.com/spf13/viper"
 )
 
 var templateContent = `
 -- +migrate Up
--- +migrate Down
-`
+{{range .Up}}{{statement .}}
+{{end}}-- +migrate Down
+{{range .Down}}{{.}}
+{{end}}`
 var tpl *template.Template
 
 func init() {
-	tpl = template.Must(template.New("new_migration").Parse(templateContent))
+	tpl = template.Must(template.New("new_migration").Funcs(template.FuncMap{"statement": formatStatement}).Parse(templateContent))
+}
+
+// Contents of a new migration
+type migrationTemplate struct {
+	Up   []string
+	Down []string
+}
+
+// Terminate a statement, marking its bounds if its body contains semicolons
+func formatStatement(stmt string) string {
+	stmt = strings.TrimSuffix(strings.TrimSpace(stmt), ";")
+	if strings.Contains(stmt, ";") {
+		return "-- +migrate StatementBegin\n" + stmt + ";\n-- +migrate StatementEnd"
+	}
+	return stmt + ";"
 }
 
 type NewCommand struct {
@@ -33,6 +48,10 @@ Usage: evedbtool new [options] name
   Create a new a database migration.
 Options:
   name                   The name of the migration
+  -source=<name>         Create the migration in the named migration source.
+  -up=<file>             Use the statements of this SQL file as the Up section.
+  -reverse               Generate the Down section from the Up statements. Statements
+                         that can't be reversed are flagged with a TODO comment.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -42,10 +61,15 @@ func (c *NewCommand) Synopsis() string {
 }
 
 func (c *NewCommand) Run(args []string) int {
+	var sourceName string
+	var upFile string
+	var reverse bool
+
 	cmdFlags := flag.NewFlagSet("new", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
-
-	migrate.SetTable("migrations")
+	cmdFlags.StringVar(&sourceName, "source", "", "Create the migration in the named migration source.")
+	cmdFlags.StringVar(&upFile, "up", "", "Use the statements of this SQL file as the Up section.")
+	cmdFlags.BoolVar(&reverse, "reverse", false, "Generate the Down section from the Up statements.")
 
 	if len(args) < 1 {
 		err := errors.New("A name for the migration is needed")
@@ -57,16 +81,51 @@ func (c *NewCommand) Run(args []string) int {
 		return 1
 	}
 
-	if err := CreateMigration(cmdFlags.Arg(0)); err != nil {
+	if cmdFlags.NArg() < 1 {
+		ui.Error("A name for the migration is needed")
+		return 1
+	}
+
+	sources, err := SelectMigrationSources(sourceName)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	if reverse && upFile == "" {
+		ui.Error("-reverse needs the Up statements given with -up")
+		return 1
+	}
+
+	var content migrationTemplate
+	if upFile != "" {
+		data, err := ioutil.ReadFile(upFile)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		if content.Up, err = SplitStatements(string(data)); err != nil {
+			ui.Error(fmt.Sprintf("Error parsing %s: %s", upFile, err))
+			return 1
+		}
+	}
+
+	if reverse {
+		var unreversible int
+		content.Down, unreversible = BuildDownSection(content.Up)
+		if unreversible > 0 {
+			ui.Warn(fmt.Sprintf("%d statements could not be reversed automatically, complete the Down section by hand", unreversible))
+		}
+	}
+
+	if err := CreateMigration(sources[0].Dir, cmdFlags.Arg(0), content); err != nil {
 		ui.Error(err.Error())
 		return 1
 	}
 	return 0
 }
 
-func CreateMigration(name string) error {
-
-	dir := viper.GetString("migrations-dir")
+func CreateMigration(dir string, name string, content migrationTemplate) error {
 
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
 		return err
@@ -81,7 +140,7 @@ func CreateMigration(name string) error {
 	}
 	defer func() { _ = f.Close() }()
 
-	if err := tpl.Execute(f, nil); err != nil {
+	if err := tpl.Execute(f, content); err != nil {
 		return err
 	}
 
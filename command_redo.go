@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/go-gorp/gorp/v3"
 	migrate "github.com/rubenv/sql-migrate"
 	"github.com/spf13/viper"
 )
@@ -18,6 +19,10 @@ Usage: evedbtool redo [options] ...
   Reapply the last migration.
 Options:
   -dryrun                Don't apply migrations, just print them.
+  -validate              Run the migration against an empty copy of the schema instead.
+  -verify-rollback       Run the Down section again if the Verify checks fail.
+  -source=<name>         Only use the named migration source.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -28,50 +33,102 @@ func (c *RedoCommand) Synopsis() string {
 
 func (c *RedoCommand) Run(args []string) int {
 	var dryrun bool
-
-	migrate.SetTable("migrations")
+	var validate bool
+	var verifyRollback bool
+	var sourceName string
 
 	cmdFlags := flag.NewFlagSet("redo", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
 	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.BoolVar(&validate, "validate", false, "Run the migration against an empty copy of the schema instead.")
+	cmdFlags.BoolVar(&verifyRollback, "verify-rollback", viper.GetBool("verify-rollback"), "Run the Down section again if the Verify checks fail.")
+	cmdFlags.StringVar(&sourceName, "source", "", "Only use the named migration source.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
 	db := getDB()
+	defer db.Close()
 	dialect := "mysql"
 
-	source := migrate.FileMigrationSource{
-		Dir: viper.GetString("migrations-dir"),
-	}
-
-	migrations, _, err := migrate.PlanMigration(db, dialect, source, migrate.Down, 1)
+	sources, err := SelectMigrationSources(sourceName)
 	if err != nil {
-		ui.Error(fmt.Sprintf("Migration (redo) failed: %v", err))
+		ui.Error(err.Error())
 		return 1
-	} else if len(migrations) == 0 {
+	}
+
+	//The last migration belongs to the last source that has one applied
+	var source SourceConfig
+	var src *FileSource
+	var migrations []*migrate.PlannedMigration
+	var dbMap *gorp.DbMap
+	for i := len(sources) - 1; i >= 0; i-- {
+		src = sources[i].Source(db)
+		migrations, dbMap, err = sources[i].Set().PlanMigration(db, dialect, src, migrate.Down, 1)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Migration (redo) failed: %v", err))
+			return 1
+		} else if len(migrations) > 0 {
+			source = sources[i]
+			break
+		}
+	}
+
+	if len(migrations) == 0 {
 		ui.Output("Nothing to do!")
 		return 0
 	}
 
-	if dryrun {
-		PrintMigration(migrations[0], migrate.Down)
-		PrintMigration(migrations[0], migrate.Up)
+	down, err := expandPlannedMigration(migrations[0], migrate.Down)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	up, err := expandPlannedMigration(&migrate.PlannedMigration{
+		Migration:          migrations[0].Migration,
+		Queries:            migrations[0].Up,
+		DisableTransaction: migrations[0].DisableTransactionUp,
+	}, migrate.Up)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	if validate {
+		if err := ValidateMigrations(db, []*migrate.PlannedMigration{down, up}); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+	} else if dryrun {
+		PrintMigration(down, migrate.Down)
+		PrintMigration(up, migrate.Up)
 	} else {
-		_, err := migrate.ExecMax(db, dialect, source, migrate.Down, 1)
+		entry := NewHistoryEntry("redo", "down", source.Name, down.Id)
+		err := applyPlannedMigration(dbMap, migrate.Down, down)
+		entry.Finish(err)
+		RecordHistory(db, entry)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Migration (down) failed: %s", err))
 			return 1
 		}
 
-		_, err = migrate.ExecMax(db, dialect, source, migrate.Up, 1)
+		entry = NewHistoryEntry("redo", "up", source.Name, up.Id)
+		err = applyPlannedMigration(dbMap, migrate.Up, up)
+		entry.Finish(err)
+		RecordHistory(db, entry)
 		if err != nil {
 			ui.Error(fmt.Sprintf("Migration (up) failed: %s", err))
 			return 1
 		}
 
-		ui.Output(fmt.Sprintf("Reapplied migration %s.", migrations[0].Id))
+		if err := verifyMigration(db, dbMap, src, up, verifyRollback, "redo", source.Name); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+
+		ui.Output(fmt.Sprintf("Reapplied migration %s.", down.Id))
 	}
 
 	return 0
@@ -1,16 +1,17 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	migrate "github.com/rubenv/sql-migrate"
 	"github.com/spf13/viper"
-	"gopkg.in/jcmturner/rpc.v1/mstypes"
 )
 
 type SeedCommand struct {
@@ -19,9 +20,23 @@ type SeedCommand struct {
 func (c *SeedCommand) Help() string {
 	helpText := `
 Usage: evedbtool seed [options] ...
-  Seeds EVEmu with default market data.
+  Seeds EVEmu with default market data. Each region in seed-regions is seeded once,
+  regions added to the configuration later are seeded on the next run. Constellation
+  and solar system names can be used to seed a smaller area, see 'evedbtool map regions'.
+  The types and stations seeded in an area are chosen by its profile under seed-region-profiles.
+Subcommands:
+  import                 Import market orders from a CSV or JSON price file.
+  watch                  Replenish seeded market orders periodically.
 Options:
+  -remove=<area>         Delete the orders seeded in a region, constellation or system.
+  -reseed=<area>         Delete the orders seeded in an area and seed it again.
+  -orders=all            Which orders to seed, remove or reseed: all, sell or buy.
+                         Buy orders are only seeded with all if enabled under seed-buy-orders.
+  -seed=<int>            RNG seed choosing stations and prices. The same configuration and
+                         seed always produce the same orders, by default a new one is logged.
+  -report=<file>         Also write the report of the seeded orders to a JSON file.
   -dryrun                Don't apply migrations, just print them.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -32,197 +47,425 @@ func (c *SeedCommand) Synopsis() string {
 
 func (c *SeedCommand) Run(args []string) int {
 	var dryrun bool
+	var remove string
+	var reseed string
+	var orders string
+	var rngSeed int64
+	var report string
 
-	cmdFlags := flag.NewFlagSet("up", flag.ContinueOnError)
+	cmdFlags := flag.NewFlagSet("seed", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
 	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't apply query, just print it.")
+	cmdFlags.StringVar(&remove, "remove", "", "Delete the orders seeded in a region.")
+	cmdFlags.StringVar(&reseed, "reseed", "", "Delete the orders seeded in a region and seed it again.")
+	cmdFlags.StringVar(&orders, "orders", "all", "Which orders to seed, remove or reseed: all, sell or buy.")
+	cmdFlags.Int64Var(&rngSeed, "seed", 0, "RNG seed choosing stations and prices.")
+	cmdFlags.StringVar(&report, "report", "", "Also write the report of the seeded orders to a JSON file.")
 
 	regionArray := viper.GetStringSlice("seed-regions")
-	saturation := viper.GetInt("seed-saturation")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	if !dryrun {
-		tables := GetNumberOfTables()
-		if tables == 0 {
-			log.Info("Database not initialized, please install the DB first")
-		} else {
-			log.Info("Seeding market...")
-			var seedQueries []string
-			for _, regionID := range regionArray {
-				log.Info("Seeding region ", regionID)
-				query := getQuery(regionID, saturation)
-				seedQueries = append(seedQueries, query)
-			}
-			migrations := []*migrate.Migration{}
-			migrations = append(migrations, buildSeedMigration(seedQueries))
+	seedGiven := false
+	cmdFlags.Visit(func(f *flag.Flag) { seedGiven = seedGiven || f.Name == "seed" })
+	if !seedGiven {
+		rngSeed = time.Now().UnixNano()
+	}
+
+	if remove != "" && reseed != "" {
+		ui.Error("Use either -remove or -reseed")
+		return 1
+	}
+	if orders != "all" && orders != "sell" && orders != "buy" {
+		ui.Error(fmt.Sprintf("Invalid -orders %q, use all, sell or buy", orders))
+		return 1
+	}
 
-			log.Info("Executing migration...")
-			migrationSource := &migrate.MemoryMigrationSource{migrations}
+	tables := GetNumberOfTables()
+	if tables == 0 {
+		log.Info("Database not initialized, please install the DB first")
+		return 0
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	//Before removing anything, so the orders of an older seed are removed as well
+	if err := AdoptLegacySeed(db, dryrun); err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
 
-			//Create a new DB connection (to avoid exhausting limit)
-			db := getDB()
-			migrate.SetTable("seed_migrations")
-			n, err := migrate.Exec(db, "mysql", migrationSource, migrate.Up)
+	if remove != "" || reseed != "" {
+		region := remove + reseed
+
+		//Removing all orders includes buy orders even if they are no longer enabled
+		migrations, err := buildAreaSeeds(db, region, orders, true, rngSeed)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+
+		removed := make(map[string]bool)
+		for _, m := range migrations {
+			applied, err := IsSeedApplied(db, m.Id)
 			if err != nil {
-				log.Error("Error installing migration: ", err)
-				//Check if DB died
-				checkDBConnection()
+				ui.Error(err.Error())
+				return 1
+			}
+			if !applied {
+				continue
+			}
+			if err := RemoveSeed(db, m, "seed", dryrun); err != nil {
+				ui.Error(err.Error())
+				return 1
+			}
+			removed[m.Id] = true
+		}
+
+		if remove != "" {
+			if len(removed) == 0 {
+				ui.Error(fmt.Sprintf("No seeded orders to remove in %s", region))
+				return 1
+			}
+			if !dryrun {
+				ui.Output(fmt.Sprintf("Removed the orders seeded in %s", region))
+			}
+			return 0
+		}
+
+		if orders == "all" {
+			if migrations, err = buildAreaSeeds(db, region, orders, false, rngSeed); err != nil {
+				ui.Error(err.Error())
+				return 1
+			}
+		}
+		log.Info("Seeding with -seed=", rngSeed)
+		if dryrun {
+			//The removed seeds are still applied, so ApplySeeds would skip them
+			for _, m := range migrations {
+				if removed[m.Id] {
+					PrintMigration(&migrate.PlannedMigration{Migration: m, Queries: m.Up}, migrate.Up)
+				}
 			}
-			db.Close()
-			log.Info("Successfully applied ", n, " migration!")
 		}
-	} else {
-		log.Info("Dry run, this is the query that will be executed:\n===\n")
-		for _, regionID := range regionArray {
-			query := getQuery(regionID, saturation)
-			log.Info("Dry run for region ", regionID, "\n---\n")
-			log.Info(query)
+		applied, err := ApplySeeds(db, migrations, dryrun)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		if !dryrun {
+			ui.Output(fmt.Sprintf("Reseeded %s", region))
+			areas := make(map[string]string)
+			for _, m := range migrations {
+				areas[m.Id] = region
+			}
+			if err := reportSeeds(db, applied, areas, report); err != nil {
+				ui.Error(err.Error())
+				return 1
+			}
+		}
+		return 0
+	}
+
+	log.Info("Seeding market with -seed=", rngSeed, "...")
+	var migrations []*migrate.Migration
+	areas := make(map[string]string)
+	for _, region := range regionArray {
+		m, err := buildAreaSeeds(db, region, orders, false, rngSeed)
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		for _, seed := range m {
+			areas[seed.Id] = region
+		}
+		migrations = append(migrations, m...)
+	}
+
+	applied, err := ApplySeeds(db, migrations, dryrun)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	if !dryrun {
+		log.Info("Successfully applied ", len(applied), " seed migrations")
+		if err := reportSeeds(db, applied, areas, report); err != nil {
+			ui.Error(err.Error())
+			return 1
 		}
 	}
 
 	return 0
 }
 
-func buildSeedMigration(seedQueries []string) *migrate.Migration {
-	log.Debug("Building migration for seed query")
+// Print the report of the applied seed migrations, and write it to file if one is given
+func reportSeeds(db *sql.DB, applied []string, areas map[string]string, file string) error {
+	if len(applied) == 0 {
+		return nil
+	}
+
+	reports, err := BuildSeedReports(db, applied, areas)
+	if err != nil {
+		return err
+	}
+	PrintSeedReports(reports)
 
-	migration := &migrate.Migration{
-		Id:   "SEED_MARKET",
-		Up:   seedQueries,
-		Down: []string{},
+	if file != "" {
+		if err := WriteSeedReports(file, reports); err != nil {
+			return err
+		}
+		log.Info("Wrote the seed report to ", file)
 	}
-	return migration
+	return nil
 }
 
-func getQuery(regionValue string, saturation int) string {
-	query := `set @regionid=RVAL; set @saturation=SVAL; create temporary table if not exists tStations (stationId int, solarSystemID int, regionID int, corporationID int, security float); truncate table tStations; select round(count(stationID)*@saturation) into @lim from staStations where regionID=@regionid ; set @i=0; insert into tStations   select stationID,solarSystemID,regionID, corporationID, security from staStations where (@i:=@i+1)<=@lim AND regionID=@regionid  order by rand(); INSERT INTO mktOrders (typeID, ownerID, regionID, stationID, price, volEntered, volRemaining, issued, minVolume, duration, solarSystemID, jumps)   SELECT typeID, corporationID, regionID, stationID, basePrice / security, 550, 550, TSTAMP, 1, 250, solarSystemID, 1   FROM tStations, invTypes inner join invGroups USING (groupID)   WHERE invTypes.published = 1   AND invGroups.categoryID IN (4, 5, 6, 7, 8, 9, 16, 17, 18, 22, 23, 24, 25, 32, 34, 35, 39, 40, 41, 42, 43, 46); UPDATE mktOrders SET price = 100 WHERE price = 0;`
-	regionMap := map[string]int{
-		"Derelik":              10000001,
-		"The Forge":            10000002,
-		"Vale of the Silent":   10000003,
-		"UUA-F4":               10000004,
-		"Detorid":              10000005,
-		"Wicked Creek":         10000006,
-		"Cache":                10000007,
-		"Scalding Pass":        10000008,
-		"Insmother":            10000009,
-		"Tribute":              10000010,
-		"Great Wildlands":      10000011,
-		"Curse":                10000012,
-		"Malpais":              10000013,
-		"Catch":                10000014,
-		"Venal":                10000015,
-		"Lonetrek":             10000016,
-		"J7HZ-F":               10000017,
-		"The Spire":            10000018,
-		"A821-A":               10000019,
-		"Tash-Murkon":          10000020,
-		"Outer Passage":        10000021,
-		"Stain":                10000022,
-		"Pure Blind":           10000023,
-		"Immensea":             10000025,
-		"Etherium Reach":       10000027,
-		"Molden Heath":         10000028,
-		"Geminate":             10000029,
-		"Heimatar":             10000030,
-		"Impass":               10000031,
-		"Sinq Laison":          10000032,
-		"The Citadel":          10000033,
-		"The Kalevala Expanse": 10000034,
-		"Deklein":              10000035,
-		"Devoid":               10000036,
-		"Everyshore":           10000037,
-		"The Bleak Lands":      10000038,
-		"Esoteria":             10000039,
-		"Oasa":                 10000040,
-		"Syndicate":            10000041,
-		"Metropolis":           10000042,
-		"Domain":               10000043,
-		"Solitude":             10000044,
-		"Tenal":                10000045,
-		"Fade":                 10000046,
-		"Providence":           10000047,
-		"Placid":               10000048,
-		"Khanid":               10000049,
-		"Querious":             10000050,
-		"Cloud Ring":           10000051,
-		"Kador":                10000052,
-		"Cobalt Edge":          10000053,
-		"Aridia":               10000054,
-		"Branch":               10000055,
-		"Feythabolis":          10000056,
-		"Outer Ring":           10000057,
-		"Fountain":             10000058,
-		"Paragon Soul":         10000059,
-		"Delve":                10000060,
-		"Tenerifis":            10000061,
-		"Omist":                10000062,
-		"Period Basis":         10000063,
-		"Essence":              10000064,
-		"Kor-Azor":             10000065,
-		"Perrigen Falls":       10000066,
-		"Genesis":              10000067,
-		"Verge Vendor":         10000068,
-		"Black Rise":           10000069,
-		"A-R00001":             11000001,
-		"A-R00002":             11000002,
-		"A-R00003":             11000003,
-		"B-R00004":             11000004,
-		"B-R00005":             11000005,
-		"B-R00006":             11000006,
-		"B-R00007":             11000007,
-		"B-R00008":             11000008,
-		"C-R00009":             11000009,
-		"C-R00010":             11000010,
-		"C-R00011":             11000011,
-		"C-R00012":             11000012,
-		"C-R00013":             11000013,
-		"C-R00014":             11000014,
-		"C-R00015":             11000015,
-		"D-R00016":             11000016,
-		"D-R00017":             11000017,
-		"D-R00018":             11000018,
-		"D-R00019":             11000019,
-		"D-R00020":             11000020,
-		"D-R00021":             11000021,
-		"D-R00022":             11000022,
-		"D-R00023":             11000023,
-		"E-R00024":             11000024,
-		"E-R00025":             11000025,
-		"E-R00026":             11000026,
-		"E-R00027":             11000027,
-		"E-R00028":             11000028,
-		"E-R00029":             11000029,
-		"F-R00030":             11000030,
-	}
-
-	var regionID string
-
-	fuzzySaturation := float32(saturation) / 100
-
-	if _, err := strconv.Atoi(regionValue); err == nil {
-		regionID = regionValue
-	} else {
-		if val, ok := regionMap[regionValue]; ok {
-			regionID = strconv.Itoa(val)
-		} else {
-			log.Error("ERR: ", regionValue, " is not a valid region name.")
-			os.Exit(1)
+// Build the seed migrations of an area for the selected kind of orders. Unless
+// allBuy is set, "all" only includes buy orders when they are enabled.
+func buildAreaSeeds(db *sql.DB, value string, orders string, allBuy bool, rngSeed int64) ([]*migrate.Migration, error) {
+	area, err := ResolveSeedArea(db, value)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := LoadSeedProfile(db, value, area)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Seeding ", area.Name, " with profile ", profile.Name)
+
+	var migrations []*migrate.Migration
+	if orders != "buy" {
+		m, err := BuildSeedMigration(db, area, profile, rngSeed)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+
+	if orders != "sell" {
+		config, err := GetBuyOrderConfig()
+		if err != nil {
+			return nil, err
+		}
+		if config.Enabled || orders == "buy" || allBuy {
+			m, err := BuildBuyOrderMigration(db, area, profile, config, rngSeed)
+			if err != nil {
+				return nil, err
+			}
+			migrations = append(migrations, m)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Import market orders from a price file
+type SeedImportCommand struct {
+}
+
+func (c *SeedImportCommand) Help() string {
+	helpText := `
+Usage: evedbtool seed import [options] ...
+  Inserts market orders from a CSV or JSON price file. CSV files need a header with the
+  columns typeID, price and volume, and optionally region and stationID. JSON files hold
+  an array of objects with the same fields. Orders without a station are placed at every
+  station of their region. The import is recorded as a seed migration named after the file.
+Options:
+  -file=<path>           The price file to import.
+  -region=<area>         Region, constellation or system for orders without station or region.
+  -duration=250          Duration of the orders in days.
+  -remove                Delete the orders imported from the file instead.
+  -reimport              Delete the orders imported from the file and import it again.
+  -dryrun                Don't insert the orders, just print the statements.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *SeedImportCommand) Synopsis() string {
+	return "Imports market orders from a CSV or JSON price file."
+}
+
+func (c *SeedImportCommand) Run(args []string) int {
+	var file string
+	var region string
+	var duration int
+	var remove bool
+	var reimport bool
+	var dryrun bool
+
+	cmdFlags := flag.NewFlagSet("import", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.StringVar(&file, "file", "", "The price file to import.")
+	cmdFlags.StringVar(&region, "region", "", "Region, constellation or system for orders without station or region.")
+	cmdFlags.IntVar(&duration, "duration", 250, "Duration of the orders in days.")
+	cmdFlags.BoolVar(&remove, "remove", false, "Delete the orders imported from the file instead.")
+	cmdFlags.BoolVar(&reimport, "reimport", false, "Delete the orders imported from the file and import it again.")
+	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't insert the orders, just print the statements.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if file == "" {
+		ui.Error("A price file is needed, use -file")
+		return 1
+	}
+	if remove && reimport {
+		ui.Error("Use either -remove or -reimport")
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	id, err := importSeedID(file)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	applied, err := IsSeedApplied(db, id)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+
+	if remove || (reimport && applied) {
+		if !applied {
+			ui.Error(fmt.Sprintf("No orders imported from %s", file))
+			return 1
+		}
+		//The Down section doesn't depend on the file content
+		m := &migrate.Migration{Id: id}
+		for _, stmt := range seedDownStatements {
+			expanded, err := ExpandVarsWith(stmt, map[string]string{"seed_id": id})
+			if err != nil {
+				ui.Error(err.Error())
+				return 1
+			}
+			m.Down = append(m.Down, expanded)
+		}
+		if err := RemoveSeed(db, m, "seed", dryrun); err != nil {
+			ui.Error(err.Error())
+			return 1
 		}
+		if remove {
+			if !dryrun {
+				ui.Output(fmt.Sprintf("Removed the orders imported from %s", file))
+			}
+			return 0
+		}
+	} else if applied {
+		ui.Error(fmt.Sprintf("%s is already imported as %s, use -reimport to replace its orders", file, id))
+		return 1
+	}
+
+	orders, err := ReadPriceFile(file)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
 	}
 
-	log.Info(regionID)
+	m, err := BuildImportMigration(db, file, orders, region, duration)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
 
-	//Generate a Microsoft timestamp
-	tstamp := mstypes.GetFileTime(time.Now()).MSEpoch()
+	if _, err := ApplySeeds(db, []*migrate.Migration{m}, dryrun); err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	if !dryrun {
+		ui.Output(fmt.Sprintf("Imported %d price entries from %s as %s", len(orders), file, id))
+	}
 
-	r := strings.NewReplacer(
-		"SVAL", fmt.Sprintf("%.2f", fuzzySaturation),
-		"RVAL", regionID,
-		"TSTAMP", strconv.FormatInt(tstamp, 10),
-	)
-	return r.Replace(query)
+	return 0
+}
+
+// Keep seeded markets stocked
+type SeedWatchCommand struct {
+}
+
+func (c *SeedWatchCommand) Help() string {
+	helpText := `
+Usage: evedbtool seed watch [options] ...
+  Replenishes seeded market orders while the server runs. On every pass, seeded orders
+  whose remaining volume fell below the threshold are topped up, and seeded orders that
+  were bought or sold out completely are recreated at their station. The defaults come
+  from seed-watch in evedb.yaml. Stops after the current pass on SIGINT or SIGTERM.
+Options:
+  -interval=10m          Time between passes.
+  -threshold=0.5         Top up orders below this fraction of their volume entered.
+  -reprice               Also reprice seeded orders with the current pricing model.
+  -once                  Run a single pass and exit.
+`
+	return strings.TrimSpace(helpText)
+}
+
+func (c *SeedWatchCommand) Synopsis() string {
+	return "Replenishes seeded market orders periodically."
+}
+
+func (c *SeedWatchCommand) Run(args []string) int {
+	var once bool
+	config := GetWatchConfig()
+
+	cmdFlags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.DurationVar(&config.Interval, "interval", config.Interval, "Time between passes.")
+	cmdFlags.Float64Var(&config.Threshold, "threshold", config.Threshold, "Top up orders below this fraction of their volume entered.")
+	cmdFlags.BoolVar(&config.Reprice, "reprice", config.Reprice, "Also reprice seeded orders.")
+	cmdFlags.BoolVar(&once, "once", false, "Run a single pass and exit.")
+
+	if err := cmdFlags.Parse(args); err != nil {
+		return 1
+	}
+
+	if config.Interval < time.Second {
+		ui.Error("Invalid -interval, use at least 1s")
+		return 1
+	}
+	if config.Threshold < 0 || config.Threshold > 1 {
+		ui.Error("Invalid -threshold, use a fraction between 0 and 1")
+		return 1
+	}
+
+	db := getDB()
+	defer db.Close()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := ReplenishSeeds(db, config)
+		if err != nil {
+			if once {
+				ui.Error(err.Error())
+				return 1
+			}
+			//Keep watching, the database may be back on the next pass
+			log.Error("Replenishing seeded orders failed: ", err)
+		} else {
+			log.Info(fmt.Sprintf("Topped up %d, recreated %d and repriced %d seeded orders", result.ToppedUp, result.Recreated, result.Repriced))
+		}
+
+		if once {
+			return 0
+		}
+
+		select {
+		case <-stop:
+			log.Info("Stopped watching seeded orders")
+			return 0
+		case <-ticker.C:
+		}
+	}
 }
@@ -1,12 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"flag"
 	"fmt"
 	"strings"
 
 	migrate "github.com/rubenv/sql-migrate"
-	"github.com/spf13/viper"
 )
 
 type SkipCommand struct {
@@ -18,6 +18,8 @@ Usage: evedbtool skip [options] ...
   Set the database level to the most recent version available, without actually running the migrations.
 Options:
   -limit=0               Limit the number of migrations (0 = unlimited).
+  -source=<name>         Only use the named migration source.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -28,49 +30,106 @@ func (c *SkipCommand) Synopsis() string {
 
 func (c *SkipCommand) Run(args []string) int {
 	var limit int
-	var dryrun bool
-
-	migrate.SetTable("migrations")
+	var sourceName string
 
 	cmdFlags := flag.NewFlagSet("up", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
 	cmdFlags.IntVar(&limit, "limit", 0, "Max number of migrations to skip.")
+	cmdFlags.StringVar(&sourceName, "source", "", "Only use the named migration source.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	err := SkipMigrations(migrate.Up, dryrun, limit)
+	sources, err := SelectMigrationSources(sourceName)
 	if err != nil {
 		ui.Error(err.Error())
 		return 1
 	}
 
+	for _, source := range sources {
+		n, err := SkipMigrations(source, limit, "", "skip")
+		if err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+		if limit > 0 {
+			limit -= n
+			if limit == 0 {
+				break
+			}
+		}
+	}
+
 	return 0
 }
 
-func SkipMigrations(dir migrate.MigrationDirection, dryrun bool, limit int) error {
+// Record migrations of a source as applied without running them, up to and
+// including the target migration if one is given.
+// Returns the number of skipped migrations.
+func SkipMigrations(source SourceConfig, limit int, target string, command string) (int, error) {
 
 	db := getDB()
-	dialect := "mysql"
-
-	source := migrate.FileMigrationSource{
-		Dir: viper.GetString("migrations-dir"),
-	}
+	defer db.Close()
 
-	n, err := migrate.SkipMax(db, dialect, source, dir, limit)
+	n, err := skipMigrations(db, command, source.Name, source.Set(), source.Source(db), limit, target, false)
 	if err != nil {
-		return fmt.Errorf("Migration failed: %s", err)
+		return n, fmt.Errorf("Migration failed for source %s: %s", source.Name, err)
 	}
 
 	switch n {
 	case 0:
-		ui.Output("All migrations have already been applied")
+		ui.Output(fmt.Sprintf("All migrations of %s have already been applied", source.Name))
 	case 1:
-		ui.Output("Skipped 1 migration")
+		ui.Output(fmt.Sprintf("Skipped 1 migration of %s", source.Name))
 	default:
-		ui.Output(fmt.Sprintf("Skipped %d migrations", n))
+		ui.Output(fmt.Sprintf("Skipped %d migrations of %s", n, source.Name))
+	}
+
+	return n, nil
+}
+
+func skipMigrations(db *sql.DB, command string, sourceName string, set migrate.MigrationSet, source migrate.MigrationSource, limit int, target string, dryrun bool) (int, error) {
+	dialect := "mysql"
+
+	migrations, dbMap, err := set.PlanMigration(db, dialect, source, migrate.Up, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	if target != "" {
+		index := -1
+		for i, m := range migrations {
+			if m.Id == target {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return 0, fmt.Errorf("Migration %s is unknown or already applied", target)
+		}
+		migrations = migrations[:index+1]
+	}
+
+	if dryrun {
+		for _, m := range migrations {
+			ui.Output(fmt.Sprintf("==> Would mark migration %s of %s as applied", m.Id, sourceName))
+		}
+		return len(migrations), nil
+	}
+
+	n := 0
+	for _, m := range migrations {
+		entry := NewHistoryEntry(command, "up", sourceName, m.Id)
+		err := skipPlannedMigration(dbMap, m)
+		entry.Finish(err)
+		RecordHistory(db, entry)
+		if err != nil {
+			return n, err
+		}
+		n++
 	}
 
-	return nil
+	return n, nil
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,6 +26,9 @@ func (c *StatusCommand) Help() string {
 Usage: evedbtool status [options] ...
   Show migration status.
 Options:
+  -source=<name>         Only show the named migration source.
+  -all                   Also show base files, seed runs and dungeons.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -29,34 +38,351 @@ func (c *StatusCommand) Synopsis() string {
 }
 
 func (c *StatusCommand) Run(args []string) int {
+	var sourceName string
+	var all bool
+
 	cmdFlags := flag.NewFlagSet("status", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
-
-	migrate.SetTable("migrations")
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
+	cmdFlags.StringVar(&sourceName, "source", "", "Only show the named migration source.")
+	cmdFlags.BoolVar(&all, "all", false, "Also show base files, seed runs and dungeons.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
 	db := getDB()
-	dialect := "mysql"
-
-	source := migrate.FileMigrationSource{
-		Dir: viper.GetString("migrations-dir"),
-	}
+	defer db.Close()
 
-	migrations, err := source.FindMigrations()
+	sources, err := SelectMigrationSources(sourceName)
 	if err != nil {
 		ui.Error(err.Error())
 		return 1
 	}
 
-	records, err := migrate.GetMigrationRecords(db, dialect)
-	if err != nil {
+	if err := printReleaseLevel(db); err != nil {
 		ui.Error(err.Error())
 		return 1
 	}
 
+	if all {
+		ui.Output(fmt.Sprintf("==> Base files (%s)", viper.GetString("base-dir")))
+		if err := printBaseStatus(db); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	for _, source := range sources {
+		ui.Output(fmt.Sprintf("==> Source %s (%s, table %s)", source.Name, source.Dir, source.Table))
+		if err := printSourceStatus(db, source); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	if all {
+		ui.Output(fmt.Sprintf("==> Repeatable migrations (%s)", repeatableDir()))
+		if err := printRepeatableStatus(db); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+
+		ui.Output("==> Market seeds")
+		if err := printSeedStatus(db); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+
+		ui.Output(fmt.Sprintf("==> Dungeons (%s)", viper.GetString("dungeon-dir")))
+		if err := printDungeonStatus(db); err != nil {
+			ui.Error(err.Error())
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Print the newest release whose marker migration is applied, if releases are defined
+func printReleaseLevel(db *sql.DB) error {
+	releases, err := LoadReleases()
+	if err != nil || releases == nil {
+		return err
+	}
+
+	current, err := CurrentRelease(db, releases)
+	if err != nil {
+		return err
+	}
+
+	if current == nil {
+		ui.Output(fmt.Sprintf("Release level: none (first release is %s)", releases[0].Name))
+	} else if current.Name == releases[len(releases)-1].Name {
+		ui.Output(fmt.Sprintf("Release level: %s (latest)", current.Name))
+	} else {
+		ui.Output(fmt.Sprintf("Release level: %s (latest is %s)", current.Name, releases[len(releases)-1].Name))
+	}
+	return nil
+}
+
+// Print which base files are installed, pending or changed since they were installed
+func printBaseStatus(db *sql.DB) error {
+	files, err := FindBaseFiles()
+	if err != nil {
+		return err
+	}
+
+	set := migrate.MigrationSet{TableName: "base_migrations"}
+	records, err := set.GetMigrationRecords(db, "mysql")
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]time.Time)
+	for _, r := range records {
+		applied[r.Id] = r.AppliedAt
+	}
+
+	checksums, err := GetBaseChecksums(db)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, file := range files {
+		id := "BASE_" + file
+		appliedAt, ok := applied[id]
+		state := "pending"
+		if ok {
+			state = "installed " + appliedAt.String()
+			//Files marked by baseline have no checksum to compare against
+			if installed, known := checksums[id]; known {
+				if checksum, err := BaseFileChecksum(file); err == nil && checksum != installed {
+					state = "changed since " + appliedAt.String()
+				}
+			}
+		}
+		rows = append(rows, []string{file, state})
+	}
+	PrintTable([]string{"Base file", "State"}, rows)
+
+	return nil
+}
+
+// Print whether the repeatable migrations are applied, pending or changed
+func printRepeatableStatus(db *sql.DB) error {
+	migrations, err := FindRepeatableMigrations()
+	if err != nil {
+		return err
+	}
+
+	checksums, appliedAt, err := GetRepeatableRecords(db)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, m := range migrations {
+		state := "pending"
+		if checksum, ok := checksums[m.Id]; ok {
+			if checksum == m.Checksum {
+				state = appliedAt[m.Id].String()
+			} else {
+				state = "changed, applied " + appliedAt[m.Id].String()
+			}
+		}
+		rows = append(rows, []string{m.Id, state})
+	}
+	PrintTable([]string{"Repeatable migration", "Applied"}, rows)
+
+	return nil
+}
+
+// Print the recorded market seed runs
+func printSeedStatus(db *sql.DB) error {
+	records, err := seedSet().GetMigrationRecords(db, "mysql")
+	if err != nil {
+		return err
+	}
+	applied := make(map[string]time.Time)
+	for _, r := range records {
+		applied[r.Id] = r.AppliedAt
+	}
+
+	counts, err := seedOrderCounts(db)
+	if err != nil {
+		return err
+	}
+	rngSeeds, err := seedRngSeeds(db)
+	if err != nil {
+		return err
+	}
+
+	buy, err := GetBuyOrderConfig()
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	configured := make(map[string]bool)
+	for _, region := range viper.GetStringSlice("seed-regions") {
+		area, err := ResolveSeedArea(db, region)
+		if err != nil {
+			rows = append(rows, []string{region, "", "invalid: " + err.Error(), "", ""})
+			continue
+		}
+
+		ids := []string{area.SeedID()}
+		if buy.Enabled {
+			ids = append(ids, area.BuySeedID())
+		}
+		for _, id := range ids {
+			configured[id] = true
+			if at, ok := applied[id]; ok {
+				rows = append(rows, []string{region, id, at.String(), strconv.Itoa(counts[id]), rngSeeds[id]})
+			} else {
+				rows = append(rows, []string{region, id, "no", "", ""})
+			}
+		}
+	}
+	for _, r := range records {
+		if !configured[r.Id] {
+			rows = append(rows, []string{"(not configured)", r.Id, r.AppliedAt.String(), strconv.Itoa(counts[r.Id]), rngSeeds[r.Id]})
+		}
+	}
+	if len(rows) == 0 {
+		rows = append(rows, []string{"(none)", "", "no", "", ""})
+	}
+	PrintTable([]string{"Region", "Seed", "Applied", "Orders", "RNG seed"}, rows)
+
+	return nil
+}
+
+// Count the tracked orders of each seed migration
+func seedOrderCounts(db *sql.DB) (map[string]int, error) {
+	counts := make(map[string]int)
+	if err := ensureSeedTables(db); err != nil {
+		return nil, err
+	}
+
+	query := "SELECT seedID, COUNT(*) FROM " + seedOrdersTable + " GROUP BY seedID"
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		counts[id] = count
+	}
+	return counts, rows.Err()
+}
+
+// Get the RNG seed each seed migration was applied with
+func seedRngSeeds(db *sql.DB) (map[string]string, error) {
+	seeds := make(map[string]string)
+
+	query := "SELECT seedID, rngSeed FROM " + seedRunsTable
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var rngSeed int64
+		if err := rows.Scan(&id, &rngSeed); err != nil {
+			return nil, err
+		}
+		seeds[id] = strconv.FormatInt(rngSeed, 10)
+	}
+	return seeds, rows.Err()
+}
+
+// Print whether the dungeons in dungeon-dir are present, absent or out of date in the database
+func printDungeonStatus(db *sql.DB) error {
+	dir := viper.GetString("dungeon-dir")
+	items, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		//No dungeon directory simply means there are no dungeons
+		items = nil
+	} else if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	for _, item := range items {
+		if item.IsDir() {
+			continue
+		}
+
+		fullpath := filepath.Join(dir, item.Name())
+		data, err := ioutil.ReadFile(fullpath)
+		if err != nil {
+			return err
+		}
+
+		var dungeon Dungeon
+		if err := json.Unmarshal(data, &dungeon); err != nil {
+			rows = append(rows, []string{item.Name(), "", "", "invalid: " + err.Error()})
+			continue
+		}
+
+		dungeonID, err := FindDungeonByUUID(db, dungeon.DungeonUUID)
+		if err != nil {
+			return err
+		}
+
+		state := "absent"
+		id := ""
+		if dungeonID != 0 {
+			current, err := LoadDungeon(db, dungeonID)
+			if err != nil {
+				return err
+			}
+			state = "present"
+			if !SameDungeon(dungeon, current) {
+				state = "out of date"
+			}
+			id = strconv.Itoa(dungeonID)
+		}
+		rows = append(rows, []string{item.Name(), dungeon.DungeonName, id, state})
+	}
+	PrintTable([]string{"File", "Dungeon", "Dungeon ID", "State"}, rows)
+
+	return nil
+}
+
+// Print the status table of a single migration source
+func printSourceStatus(db *sql.DB, source SourceConfig) error {
+	dialect := "mysql"
+
+	src := source.Source(db)
+	migrations, err := src.FindMigrations()
+	if err != nil {
+		return err
+	}
+
+	//Migrations left out by their tags are listed in order with the others
+	listed := append([]*migrate.Migration{}, migrations...)
+	for id := range src.Filtered {
+		listed = append(listed, &migrate.Migration{Id: id})
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Less(listed[j]) })
+
+	records, err := source.Set().GetMigrationRecords(db, dialect)
+	if err != nil {
+		return err
+	}
+
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"Migration", "Applied"})
 	table.SetColWidth(60)
@@ -70,6 +396,11 @@ func (c *StatusCommand) Run(args []string) int {
 		}
 	}
 
+	gaps := outOfOrderMigrations(migrations, records)
+	for _, m := range gaps {
+		rows[m.Id].OutOfOrder = true
+	}
+
 	for _, r := range records {
 		if rows[r.Id] == nil {
 			ui.Warn(fmt.Sprintf("Could not find migration file: %v", r.Id))
@@ -80,12 +411,22 @@ func (c *StatusCommand) Run(args []string) int {
 		rows[r.Id].AppliedAt = r.AppliedAt
 	}
 
-	for _, m := range migrations {
-		if rows[m.Id] != nil && rows[m.Id].Migrated {
+	for _, m := range listed {
+		if reason, ok := src.Filtered[m.Id]; ok {
+			table.Append([]string{
+				m.Id,
+				"filtered (" + reason + ")",
+			})
+		} else if rows[m.Id] != nil && rows[m.Id].Migrated {
 			table.Append([]string{
 				m.Id,
 				rows[m.Id].AppliedAt.String(),
 			})
+		} else if rows[m.Id] != nil && rows[m.Id].OutOfOrder {
+			table.Append([]string{
+				m.Id,
+				"no (gap: older than newest applied)",
+			})
 		} else {
 			table.Append([]string{
 				m.Id,
@@ -96,11 +437,16 @@ func (c *StatusCommand) Run(args []string) int {
 
 	table.Render()
 
-	return 0
+	if len(gaps) > 0 {
+		ui.Warn(fmt.Sprintf("%d migrations are out of order, use 'up -allow-out-of-order' to apply them", len(gaps)))
+	}
+
+	return nil
 }
 
 type statusRow struct {
-	Id        string
-	Migrated  bool
-	AppliedAt time.Time
+	Id         string
+	Migrated   bool
+	OutOfOrder bool
+	AppliedAt  time.Time
 }
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
 )
 
 type UpCommand struct {
@@ -17,6 +18,12 @@ Usage: evedbtool up [options] ...
 Options:
   -limit=0               Limit the number of migrations (0 = unlimited).
   -dryrun                Don't apply migrations, just print them.
+  -validate              Run the migrations against an empty copy of the schema instead.
+  -source=<name>         Only use the named migration source.
+  -to-release=<name>     Only apply migrations up to the marker of this release (see releases.yaml).
+  -allow-out-of-order    Apply migrations older than the newest applied one.
+  -verify-rollback       Run the Down section of a migration whose Verify checks fail.
+  -var name=value        Set a variable for the SQL files, can be repeated.
 `
 	return strings.TrimSpace(helpText)
 }
@@ -26,21 +33,24 @@ func (c *UpCommand) Synopsis() string {
 }
 
 func (c *UpCommand) Run(args []string) int {
-	var limit int
-	var dryrun bool
-
-	migrate.SetTable("migrations")
+	opts := ApplyOptions{Command: "up"}
 
 	cmdFlags := flag.NewFlagSet("up", flag.ContinueOnError)
 	cmdFlags.Usage = func() { ui.Output(c.Help()) }
-	cmdFlags.IntVar(&limit, "limit", 0, "Max number of migrations to apply.")
-	cmdFlags.BoolVar(&dryrun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.Var(varFlag{}, "var", "Set a variable for the SQL files (name=value).")
+	cmdFlags.IntVar(&opts.Limit, "limit", 0, "Max number of migrations to apply.")
+	cmdFlags.BoolVar(&opts.DryRun, "dryrun", false, "Don't apply migrations, just print them.")
+	cmdFlags.BoolVar(&opts.Validate, "validate", false, "Run the migrations against an empty copy of the schema instead.")
+	cmdFlags.StringVar(&opts.Source, "source", "", "Only use the named migration source.")
+	cmdFlags.StringVar(&opts.Release, "to-release", "", "Only apply migrations up to the marker of this release.")
+	cmdFlags.BoolVar(&opts.AllowOutOfOrder, "allow-out-of-order", false, "Apply migrations older than the newest applied one.")
+	cmdFlags.BoolVar(&opts.VerifyRollback, "verify-rollback", viper.GetBool("verify-rollback"), "Run the Down section of a migration whose Verify checks fail.")
 
 	if err := cmdFlags.Parse(args); err != nil {
 		return 1
 	}
 
-	err := ApplyMigrations(migrate.Up, dryrun, limit)
+	err := ApplyMigrations(migrate.Up, opts)
 	if err != nil {
 		ui.Error(err.Error())
 		return 1
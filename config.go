@@ -7,6 +7,7 @@ package main
 import (
 	"fmt"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -21,12 +22,14 @@ func initConfig() {
 
 			//Set Defaults
 			viper.SetDefault("log-level", "Info")
+			viper.SetDefault("environment", "production")
 			viper.SetDefault("db-host", "127.0.0.1")
 			viper.SetDefault("db-port", "3306")
 			viper.SetDefault("db-user", "evemu")
 			viper.SetDefault("db-pass", "evemu")
 			viper.SetDefault("db-database", "evemu")
 			viper.SetDefault("migrations-dir", "migrations")
+			viper.SetDefault("repeatable-dir", "repeatable")
 			viper.SetDefault("base-dir", "base")
 			viper.SetDefault("dungeon-dir", "dungeons")
 
@@ -35,6 +38,18 @@ func initConfig() {
 
 			viper.SetDefault("seed-regions", seededRegions)
 			viper.SetDefault("seed-saturation", 80)
+			viper.SetDefault("seed-pricing.base-source", "invTypes")
+			viper.SetDefault("seed-pricing.default-price", 100)
+			viper.SetDefault("seed-buy-orders.enabled", false)
+			viper.SetDefault("seed-watch.interval", "10m")
+			viper.SetDefault("seed-watch.threshold", 0.5)
+			viper.SetDefault("seed-watch.reprice", false)
+
+			viper.SetDefault("retry.initial-interval", "500ms")
+			viper.SetDefault("retry.max-interval", "30s")
+			viper.SetDefault("retry.max-elapsed-time", "5m")
+			viper.SetDefault("retry.multiplier", 2)
+			viper.SetDefault("retry.jitter", 0.2)
 
 			//Write configuration file to disk
 			viper.WriteConfigAs("./evedb.yaml")
@@ -43,3 +58,11 @@ func initConfig() {
 		}
 	}
 }
+
+// Unmarshal a configuration section over defaults. Lists in the configuration replace
+// the default lists instead of being merged into them.
+func unmarshalOverDefaults(key string, target interface{}) error {
+	return viper.UnmarshalKey(key, target, func(c *mapstructure.DecoderConfig) {
+		c.ZeroFields = true
+	})
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -17,7 +20,11 @@ import (
 )
 
 func getDB() *sql.DB { //Create database connection
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?multiStatements=true&parseTime=true&maxAllowedPacket=0", viper.GetString("db-user"), viper.GetString("db-pass"), viper.GetString("db-host"), viper.GetString("db-port"), viper.GetString("db-database"))
+	return getDBFor(viper.GetString("db-database"))
+}
+
+func getDBFor(database string) *sql.DB { //Create database connection to a specific schema on the configured server
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?multiStatements=true&parseTime=true&maxAllowedPacket=0", viper.GetString("db-user"), viper.GetString("db-pass"), viper.GetString("db-host"), viper.GetString("db-port"), database)
 	dialect := "mysql"
 	db, err := sql.Open(dialect, dsn)
 	if err != nil {
@@ -30,23 +37,6 @@ func getDB() *sql.DB { //Create database connection
 	return db
 }
 
-func checkDBConnection() {
-	tries := 0
-	for tries < 1000 {
-		db := getDB()
-		_, err := db.Query("SELECT 1") //Query doesn't need to do anything, we just use to see if DB is not dead
-		if err == nil {
-			db.Close()
-			log.Info("DB connection re-established.")
-			break
-		}
-		db.Close()
-		log.Info("DB connection died, writing for server...")
-		time.Sleep(2 * time.Second)
-		tries += 1
-	}
-}
-
 func GetNumberOfTables() int {
 	db := getDB()
 	var value string
@@ -119,17 +109,94 @@ func BuildMigration(fileName string, data []string) *migrate.Migration {
 	return migration
 }
 
-func InstallBase() {
+// Whether ${name} variables are expanded in base files, dumps containing "${" in
+// their data can turn it off
+func expandBaseVars() bool {
+	if viper.IsSet("base-expand-vars") {
+		return viper.GetBool("base-expand-vars")
+	}
+	return true
+}
 
+// Get all base files in base-dir
+func FindBaseFiles() ([]string, error) {
 	var files []string
 
 	//Walk base dir for all files and put that into an array
 	err := filepath.Walk(viper.GetString("base-dir"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if !info.IsDir() { //We only want files, not dirs
 			files = append(files, path)
 		}
 		return nil
 	})
+	return files, err
+}
+
+// Table tracking the checksum of every installed base file
+const baseChecksumTable = "base_checksums"
+
+func ensureBaseChecksumTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS ` + baseChecksumTable + ` (
+		id VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		PRIMARY KEY (id)
+	)`
+	log.Trace("QUERY: ", query)
+	_, err := db.Exec(query)
+	return err
+}
+
+// Checksum of the content of a base file
+func BaseFileChecksum(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Get the checksums of the base files at the time they were installed
+func GetBaseChecksums(db *sql.DB) (map[string]string, error) {
+	if err := ensureBaseChecksumTable(db); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, checksum FROM ` + baseChecksumTable
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := make(map[string]string)
+	for rows.Next() {
+		var id, checksum string
+		if err := rows.Scan(&id, &checksum); err != nil {
+			return nil, err
+		}
+		checksums[id] = checksum
+	}
+	return checksums, rows.Err()
+}
+
+func recordBaseChecksum(db *sql.DB, id string, checksum string) error {
+	if err := ensureBaseChecksumTable(db); err != nil {
+		return err
+	}
+	query := `INSERT INTO ` + baseChecksumTable + ` (id, checksum) VALUES (?, ?) ON DUPLICATE KEY UPDATE checksum = VALUES(checksum)`
+	log.Trace("QUERY: ", query)
+	_, err := db.Exec(query, id, checksum)
+	return err
+}
+
+func InstallBase() {
+
+	files, err := FindBaseFiles()
 	if err != nil {
 		log.Error("ERROR: ", err)
 	}
@@ -140,6 +207,17 @@ func InstallBase() {
 	migrations := []*migrate.Migration{}
 	migrate.SetTable("base_migrations")
 
+	installed := make(map[string]bool)
+	db := getDB()
+	records, err := migrate.MigrationSet{TableName: "base_migrations"}.GetMigrationRecords(db, "mysql")
+	db.Close()
+	if err != nil {
+		log.Fatal("Failed to read the installed base files: ", err)
+	}
+	for _, r := range records {
+		installed[r.Id] = true
+	}
+
 	for _, file := range files {
 		log.Debug("Decompressing ", file, "...")
 
@@ -148,21 +226,50 @@ func InstallBase() {
 		if err != nil {
 			log.Error("Failed to read in GZ data: ", err)
 		}
+		//Installed files aren't run again, so their variables don't matter
+		if expandBaseVars() && !installed["BASE_"+file] {
+			for i := range fileData {
+				if fileData[i], err = ExpandVars(fileData[i]); err != nil {
+					log.Fatal("Failed to expand variables in ", file, ": ", err, " (write $${ for a literal ${, or set base-expand-vars: false)")
+				}
+			}
+		}
 
 		log.Info("Building migration for ", file, "...")
 		newMigration := BuildMigration(file, fileData)
 		migrations = append(migrations, newMigration)
 
 		log.Info("Executing migration...")
-		migrationSource := &migrate.MemoryMigrationSource{migrations}
+		migrationSource := &migrate.MemoryMigrationSource{Migrations: migrations}
 
 		//Create a new DB connection (to avoid exhausting limit)
 		db := getDB()
-		n, err := migrate.Exec(db, "mysql", migrationSource, migrate.Up)
+		entry := NewHistoryEntry("install", "up", "base", newMigration.Id)
+		var n int
+		//Base files create tables, which commits implicitly, so a file that failed half
+		//way can't be run again and only connecting is retried
+		err = GetRetryPolicy().DoIdempotent("Connecting to install "+file, db.Ping)
+		if err == nil {
+			n, err = migrate.Exec(db, "mysql", migrationSource, migrate.Up)
+		}
+		entry.Finish(err)
 		if err != nil {
 			log.Error("Error installing migration: ", err)
 			//Check if DB died
-			checkDBConnection()
+			if err := waitForDB(); err != nil {
+				log.Fatal("Database is unavailable: ", err)
+			}
+		}
+		if n > 0 {
+			//Remember what was installed, so status can tell when the file changes
+			if checksum, err := BaseFileChecksum(file); err != nil {
+				log.Warn("Cannot checksum ", file, ": ", err)
+			} else if err := recordBaseChecksum(db, newMigration.Id, checksum); err != nil {
+				log.Warn("Cannot record the checksum of ", file, ": ", err)
+			}
+		}
+		if n > 0 || err != nil {
+			RecordHistory(db, entry)
 		}
 		db.Close()
 		log.Info("Applied ", n, " migrations!")
@@ -183,5 +290,5 @@ func InstallMigrations() {
 		log.Error("Error installing migration: ", err)
 	}
 	db.Close()
-	log.Info("Applied %d migrations!\n", n)
+	log.Infof("Applied %d migrations!", n)
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 )
 
 type RoomObject struct {
@@ -63,50 +66,112 @@ func ListDungeons() []ListItem {
 // Export a dungeon from the database into a JSON string
 func ExportDungeon(dungeonID int) string {
 	db := getDB()
+	defer db.Close()
+
+	dungeon, err := LoadDungeon(db, dungeonID)
+	if err != nil {
+		log.Fatal("Failed to query db; ", err)
+	}
+
+	if output, err := json.Marshal(dungeon); err != nil {
+		log.Fatal("Failed to marshal dungeon JSON; ", err)
+	} else {
+		return string(output)
+	}
+	return ""
+}
+
+// Read a dungeon with its rooms and their objects from the database
+func LoadDungeon(db *sql.DB, dungeonID int) (Dungeon, error) {
 	var dungeon Dungeon
 
 	// Query dungeon
 	dungeonQuery := `SELECT dungeonUUID, dungeonName, dungeonStatus, factionID, archetypeID FROM dunDungeons WHERE dungeonID = ?`
 	log.Trace("QUERY: ", dungeonQuery)
 	if err := db.QueryRow(dungeonQuery, dungeonID).Scan(&dungeon.DungeonUUID, &dungeon.DungeonName, &dungeon.Status, &dungeon.FactionID, &dungeon.ArchetypeID); err != nil {
-		log.Fatal("Failed to query db; ", err)
+		return dungeon, err
 	}
 
 	// Query rooms
 	roomQuery := `SELECT roomID, roomName from dunRooms WHERE dungeonID = ? ORDER BY roomID ASC`
 	log.Trace("QUERY: ", roomQuery)
-	if rows, err := db.Query(roomQuery, dungeonID); err != nil {
-		log.Fatal("Failed to query db; ", err)
-	} else {
-		defer rows.Close()
+	rows, err := db.Query(roomQuery, dungeonID)
+	if err != nil {
+		return dungeon, err
+	}
+	var roomIDs []int
+	for rows.Next() {
+		var id int
+		var room Room
+		if err := rows.Scan(&id, &room.RoomName); err != nil {
+			rows.Close()
+			return dungeon, err
+		}
+		roomIDs = append(roomIDs, id)
+		dungeon.Rooms = append(dungeon.Rooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return dungeon, err
+	}
+
+	// Query objects
+	objectQuery := `SELECT typeID, groupID, x, y, z, yaw, pitch, roll, radius FROM dunRoomObjects WHERE roomID = ?`
+	log.Trace("QUERY: ", objectQuery)
+	for i, id := range roomIDs {
+		rows, err := db.Query(objectQuery, id)
+		if err != nil {
+			return dungeon, err
+		}
 		for rows.Next() {
-			var id int
-			var room Room
-			err = rows.Scan(&id, &room.RoomName)
-
-			// Query objects
-			objectQuery := `SELECT typeID, groupID, x, y, z, yaw, pitch, roll, radius FROM dunRoomObjects WHERE roomID = ?`
-			log.Trace("QUERY: ", objectQuery)
-			if rows, err := db.Query(objectQuery, id); err != nil {
-				log.Fatal("Failed to query db; ", err)
-			} else {
-				defer rows.Close()
-				for rows.Next() {
-					var object RoomObject
-					err = rows.Scan(&object.TypeID, &object.GroupID, &object.X, &object.Y, &object.Z, &object.Yaw, &object.Pitch, &object.Roll, &object.Radius)
-					room.Objects = append(room.Objects, object)
-				}
+			var object RoomObject
+			if err := rows.Scan(&object.TypeID, &object.GroupID, &object.X, &object.Y, &object.Z, &object.Yaw, &object.Pitch, &object.Roll, &object.Radius); err != nil {
+				rows.Close()
+				return dungeon, err
 			}
-			dungeon.Rooms = append(dungeon.Rooms, room)
+			dungeon.Rooms[i].Objects = append(dungeon.Rooms[i].Objects, object)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return dungeon, err
 		}
 	}
 
-	if output, err := json.Marshal(dungeon); err != nil {
-		log.Fatal("Failed to marshal dungeon JSON; ", err)
-	} else {
-		return string(output)
+	return dungeon, nil
+}
+
+// Find the ID of a dungeon by its UUID, returns 0 if it is not in the database
+func FindDungeonByUUID(db *sql.DB, dungeonUUID string) (int, error) {
+	var dungeonID int
+	query := `SELECT dungeonID FROM dunDungeons WHERE dungeonUUID = ?`
+	log.Trace("QUERY: ", query)
+	err := db.QueryRow(query, dungeonUUID).Scan(&dungeonID)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-	return ""
+	return dungeonID, err
+}
+
+// Compare the content of two dungeons, ignoring the format version
+func SameDungeon(a Dungeon, b Dungeon) bool {
+	normalize := func(d Dungeon) Dungeon {
+		d.Version = 0
+		if len(d.Rooms) == 0 {
+			d.Rooms = nil
+		}
+		rooms := make([]Room, len(d.Rooms))
+		for i, room := range d.Rooms {
+			if len(room.Objects) == 0 {
+				room.Objects = nil
+			}
+			rooms[i] = room
+		}
+		if d.Rooms != nil {
+			d.Rooms = rooms
+		}
+		return d
+	}
+	return reflect.DeepEqual(normalize(a), normalize(b))
 }
 
 // Get list of factions from database
@@ -179,47 +244,74 @@ func ListRooms(dungeonID int) []ListItem {
 }
 
 // Import a dungeon from a JSON string into the database
-func ImportDungeon(data []byte, overwrite bool) int {
-	db := getDB()
+func ImportDungeon(data []byte, overwrite bool) error {
 	var dungeon Dungeon
-
 	if err := json.Unmarshal(data, &dungeon); err != nil {
-		log.Fatal("Failed to unmarshal dungeon JSON; ", err)
-		return 1
+		return fmt.Errorf("Failed to unmarshal dungeon JSON: %s", err)
 	}
 
-	// Check if UUID is unique. If not, return an error or overwrite.
-	var matchCount int
-	dungeonUUIDQuery := `SELECT COUNT(*) FROM dunDungeons WHERE dungeonUUID = ?`
-	log.Trace("QUERY: ", dungeonUUIDQuery)
-	if err := db.QueryRow(dungeonUUIDQuery, dungeon.DungeonUUID).Scan(&matchCount); err != nil {
-		log.Fatal("Failed to query db; ", err.Error())
-		return 1
+	db := getDB()
+	defer db.Close()
+
+	entry := NewHistoryEntry("dungeon", "import", "dungeon", dungeon.DungeonUUID)
+	matchCount, err := checkDungeonUUID(db, dungeon.DungeonUUID, overwrite)
+	if err == nil {
+		//The dungeon is inserted in one transaction, so a failed attempt leaves nothing behind.
+		//After a lost connection it is imported if its UUID has one more match than before.
+		err = inTransaction(db, "Importing dungeon "+dungeon.DungeonUUID, func(tx *sql.Tx) error {
+			return importDungeon(tx, dungeon)
+		}, func() (bool, error) {
+			n, err := countDungeonUUID(db, dungeon.DungeonUUID)
+			return n > matchCount, err
+		})
+		if err != nil {
+			err = fmt.Errorf("Failed to query db: %s", err)
+		}
+	}
+	entry.Finish(err)
+	RecordHistory(db, entry)
+	return err
+}
+
+// Check if UUID is unique. If not, return an error or overwrite. Returns the number of
+// dungeons with the UUID.
+func checkDungeonUUID(db *sql.DB, dungeonUUID string, overwrite bool) (int, error) {
+	matchCount, err := countDungeonUUID(db, dungeonUUID)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to query db: %s", err)
 	} else if matchCount > 0 {
 		if overwrite {
-			log.Info(fmt.Sprintf("Overwriting dungeon %s.", dungeon.DungeonUUID))
+			log.Info(fmt.Sprintf("Overwriting dungeon %s.", dungeonUUID))
 		} else {
-			log.Error("This dungeon already exists in the database.")
-			return 1
+			return matchCount, fmt.Errorf("Dungeon %s already exists in the database", dungeonUUID)
 		}
 	}
+	return matchCount, nil
+}
 
+func countDungeonUUID(db *sql.DB, dungeonUUID string) (int, error) {
+	var matchCount int
+	dungeonUUIDQuery := `SELECT COUNT(*) FROM dunDungeons WHERE dungeonUUID = ?`
+	log.Trace("QUERY: ", dungeonUUIDQuery)
+	err := db.QueryRow(dungeonUUIDQuery, dungeonUUID).Scan(&matchCount)
+	return matchCount, err
+}
+
+func importDungeon(tx *sql.Tx, dungeon Dungeon) error {
 	// Determine next dungeonID
 	var dungeonCount int
 	var dungeonID int
 	dungeonCountQuery := `SELECT COUNT(*) FROM dunDungeons`
 	log.Trace("QUERY: ", dungeonCountQuery)
-	if err := db.QueryRow(dungeonCountQuery).Scan(&dungeonCount); err != nil {
-		log.Fatal("Failed to query db; ", err.Error())
-		return 1
+	if err := tx.QueryRow(dungeonCountQuery).Scan(&dungeonCount); err != nil {
+		return err
 	} else if dungeonCount == 0 {
 		dungeonID = 120000000 // Default first dungeonID
 	} else {
 		dungeonIDQuery := `SELECT MAX(dungeonID) FROM dunDungeons`
 		log.Trace("QUERY: ", dungeonIDQuery)
-		if err := db.QueryRow(dungeonIDQuery).Scan(&dungeonID); err != nil {
-			log.Fatal("Failed to query db; ", err.Error())
-			return 1
+		if err := tx.QueryRow(dungeonIDQuery).Scan(&dungeonID); err != nil {
+			return err
 		}
 		// Increment by one to find the next valid dungeonID
 		dungeonID++
@@ -230,17 +322,15 @@ func ImportDungeon(data []byte, overwrite bool) int {
 	var roomID int
 	roomCountQuery := `SELECT COUNT(*) FROM dunRooms`
 	log.Trace("QUERY: ", roomCountQuery)
-	if err := db.QueryRow(roomCountQuery).Scan(&roomCount); err != nil {
-		log.Fatal("Failed to query db; ", err.Error())
-		return 1
+	if err := tx.QueryRow(roomCountQuery).Scan(&roomCount); err != nil {
+		return err
 	} else if roomCount == 0 {
 		roomID = 10000 // Default first roomID
 	} else {
 		roomIDQuery := `SELECT MAX(roomID) FROM dunRooms`
 		log.Trace("QUERY: ", roomIDQuery)
-		if err := db.QueryRow(roomIDQuery).Scan(&roomID); err != nil {
-			log.Fatal("Failed to query db; ", err.Error())
-			return 1
+		if err := tx.QueryRow(roomIDQuery).Scan(&roomID); err != nil {
+			return err
 		}
 		//Increment by one to find the next valid roomID
 		roomID++
@@ -250,9 +340,8 @@ func ImportDungeon(data []byte, overwrite bool) int {
 	var roomObjectID int
 	roomObjectIDQuery := `SELECT MAX(objectID) FROM dunRoomObjects`
 	log.Trace("QUERY: ", roomObjectIDQuery)
-	if err := db.QueryRow(roomObjectIDQuery).Scan(&roomObjectID); err != nil {
-		log.Fatal("Failed to query db; ", err.Error())
-		return 1
+	if err := tx.QueryRow(roomObjectIDQuery).Scan(&roomObjectID); err != nil {
+		return err
 	}
 	//Increment by one to find the next valid roomObjectID
 	roomObjectID++
@@ -261,62 +350,77 @@ func ImportDungeon(data []byte, overwrite bool) int {
 	dungeonQuery := `INSERT INTO dunDungeons (dungeonUUID, dungeonID, dungeonName, dungeonStatus, factionID, archetypeID) VALUES (?, ?, ?, ?, ?, ?)`
 	log.Trace("QUERY: ", dungeonQuery)
 
-	if _, err := db.Exec(dungeonQuery, dungeon.DungeonUUID, dungeonID, dungeon.DungeonName, dungeon.Status, dungeon.FactionID, dungeon.ArchetypeID); err != nil {
-		log.Fatal("Failed to query db; ", err)
-		return 1
+	if _, err := tx.Exec(dungeonQuery, dungeon.DungeonUUID, dungeonID, dungeon.DungeonName, dungeon.Status, dungeon.FactionID, dungeon.ArchetypeID); err != nil {
+		return err
 	}
 
 	// Insert rooms
 	for _, room := range dungeon.Rooms {
 		roomQuery := `INSERT INTO dunRooms (dungeonID, roomID, roomName) VALUES (?,?,?)`
 		log.Trace("QUERY: ", roomQuery)
-		if _, err := db.Exec(roomQuery, dungeonID, roomID, room.RoomName); err != nil {
-			log.Fatal("Failed to query db; ", err)
-			return 1
+		if _, err := tx.Exec(roomQuery, dungeonID, roomID, room.RoomName); err != nil {
+			return err
 		}
 
 		// Insert roomObjects
 		roomObjectQuery := `INSERT INTO dunRoomObjects (roomID, objectID, typeID, groupID, x, y, z, yaw, pitch, roll, radius) VALUES (?,?,?,?,?,?,?,?,?,?,?)`
 		log.Trace("QUERY: ", roomObjectQuery)
 		for _, roomObject := range room.Objects {
-			if _, err := db.Exec(roomObjectQuery, roomID, roomObjectID, roomObject.TypeID, roomObject.GroupID, roomObject.X, roomObject.Y, roomObject.Z, roomObject.Yaw, roomObject.Pitch, roomObject.Roll, roomObject.Radius); err != nil {
-				log.Fatal("Failed to query db; ", err)
-				return 1
+			if _, err := tx.Exec(roomObjectQuery, roomID, roomObjectID, roomObject.TypeID, roomObject.GroupID, roomObject.X, roomObject.Y, roomObject.Z, roomObject.Yaw, roomObject.Pitch, roomObject.Roll, roomObject.Radius); err != nil {
+				return err
 			}
 			roomObjectID++
 		}
 		roomID++
 	}
-	return 0
+
+	return nil
 }
 
 // Delete an entire dungeon from the database
-func DeleteDungeon(dungeonID int) int {
+func DeleteDungeon(dungeonID int) error {
 	db := getDB()
+	defer db.Close()
+
+	entry := NewHistoryEntry("dungeon", "delete", "dungeon", strconv.Itoa(dungeonID))
+	err := inTransaction(db, "Deleting dungeon "+strconv.Itoa(dungeonID), func(tx *sql.Tx) error {
+		return deleteDungeon(tx, dungeonID)
+	}, func() (bool, error) {
+		var n int
+		query := `SELECT COUNT(*) FROM dunDungeons WHERE dungeonID = ?`
+		log.Trace("QUERY: ", query)
+		err := db.QueryRow(query, dungeonID).Scan(&n)
+		return n == 0, err
+	})
+	if err != nil {
+		err = fmt.Errorf("Failed to query db: %s", err)
+	}
+	entry.Finish(err)
+	RecordHistory(db, entry)
+	return err
+}
 
+func deleteDungeon(tx *sql.Tx, dungeonID int) error {
 	// Delete all room objects associated with the dungeon
 	query := `DELETE FROM dunRoomObjects WHERE roomID IN (SELECT roomID FROM dunRooms WHERE dungeonID=?)`
 	log.Trace("QUERY: ", query)
-	if _, err := db.Exec(query, dungeonID); err != nil {
-		log.Fatal("Failed to query db; ", err)
-		return 1
+	if _, err := tx.Exec(query, dungeonID); err != nil {
+		return err
 	}
 
 	// Delete all rooms associated with the dungeon
 	query = `DELETE FROM dunRooms WHERE dungeonID=?`
 	log.Trace("QUERY: ", query)
-	if _, err := db.Exec(query, dungeonID); err != nil {
-		log.Fatal("Failed to query db; ", err)
-		return 1
+	if _, err := tx.Exec(query, dungeonID); err != nil {
+		return err
 	}
 
 	// Finally, delete the dungeon itself
 	query = `DELETE FROM dunDungeons WHERE dungeonID=?`
 	log.Trace("QUERY: ", query)
-	if _, err := db.Exec(query, dungeonID); err != nil {
-		log.Fatal("Failed to query db; ", err)
-		return 1
+	if _, err := tx.Exec(query, dungeonID); err != nil {
+		return err
 	}
 
-	return 0
+	return nil
 }
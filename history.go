@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// Table used to audit every change made to the database by the tool
+const historyTable = "migration_history"
+
+// A single audited action, usually one migration applied in one direction
+type HistoryEntry struct {
+	ID          int64     `json:"id"`
+	Command     string    `json:"command"`
+	Direction   string    `json:"direction"`
+	Source      string    `json:"source"`
+	MigrationID string    `json:"migrationID"`
+	User        string    `json:"user"`
+	Host        string    `json:"host"`
+	Version     string    `json:"version"`
+	StartedAt   time.Time `json:"startedAt"`
+	DurationMs  int64     `json:"durationMs"`
+	Success     bool      `json:"success"`
+	Message     string    `json:"message"`
+}
+
+// Filters for querying the audit history, empty values match everything
+type HistoryFilter struct {
+	//started_at is written in UTC by the driver
+	Since       time.Time
+	Until       time.Time
+	Command     string
+	Source      string
+	MigrationID string
+	Limit       int
+}
+
+// Start a new history entry for the running command
+func NewHistoryEntry(command string, direction string, source string, migrationID string) *HistoryEntry {
+	entry := &HistoryEntry{
+		Command:     command,
+		Direction:   direction,
+		Source:      source,
+		MigrationID: migrationID,
+		Version:     version,
+		StartedAt:   time.Now(),
+	}
+
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	} else {
+		entry.User = os.Getenv("USER")
+	}
+	if host, err := os.Hostname(); err == nil {
+		entry.Host = host
+	}
+
+	return entry
+}
+
+// Mark the entry as done, recording the result of the action
+func (e *HistoryEntry) Finish(err error) {
+	e.DurationMs = time.Since(e.StartedAt).Milliseconds()
+	e.Success = err == nil
+	if err != nil {
+		e.Message = err.Error()
+	}
+}
+
+func ensureHistoryTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS ` + historyTable + ` (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		command VARCHAR(64) NOT NULL,
+		direction VARCHAR(16) NOT NULL,
+		source VARCHAR(64) NOT NULL,
+		migration_id VARCHAR(255) NOT NULL,
+		user VARCHAR(128) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		tool_version VARCHAR(64) NOT NULL,
+		started_at DATETIME(3) NOT NULL,
+		duration_ms BIGINT NOT NULL,
+		success TINYINT(1) NOT NULL,
+		message TEXT,
+		PRIMARY KEY (id),
+		KEY started_at (started_at),
+		KEY migration_id (migration_id)
+	)`
+	log.Trace("QUERY: ", query)
+	_, err := db.Exec(query)
+	return err
+}
+
+// Write the finished entry to the audit table.
+// Failing to audit never fails the command itself, it is only logged.
+func RecordHistory(db *sql.DB, entry *HistoryEntry) {
+	if err := ensureHistoryTable(db); err != nil {
+		log.Warn("Failed to create history table; ", err)
+		return
+	}
+
+	query := `INSERT INTO ` + historyTable + ` (command, direction, source, migration_id, user, host, tool_version, started_at, duration_ms, success, message) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	log.Trace("QUERY: ", query)
+	if _, err := db.Exec(query, entry.Command, entry.Direction, entry.Source, entry.MigrationID, entry.User, entry.Host, entry.Version, entry.StartedAt, entry.DurationMs, entry.Success, entry.Message); err != nil {
+		log.Warn("Failed to record history; ", err)
+	}
+}
+
+// Query the audit history, newest entries first
+func QueryHistory(db *sql.DB, filter HistoryFilter) ([]HistoryEntry, error) {
+	if err := ensureHistoryTable(db); err != nil {
+		return nil, err
+	}
+
+	var where []string
+	var args []interface{}
+	if !filter.Since.IsZero() {
+		where = append(where, "started_at >= ?")
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "started_at < ?")
+		args = append(args, filter.Until)
+	}
+	if filter.Command != "" {
+		where = append(where, "command = ?")
+		args = append(args, filter.Command)
+	}
+	if filter.Source != "" {
+		where = append(where, "source = ?")
+		args = append(args, filter.Source)
+	}
+	if filter.MigrationID != "" {
+		where = append(where, "migration_id LIKE ?")
+		args = append(args, "%"+filter.MigrationID+"%")
+	}
+
+	query := `SELECT id, command, direction, source, migration_id, user, host, tool_version, started_at, duration_ms, success, COALESCE(message, '') FROM ` + historyTable
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var e HistoryEntry
+		if err := rows.Scan(&e.ID, &e.Command, &e.Direction, &e.Source, &e.MigrationID, &e.User, &e.Host, &e.Version, &e.StartedAt, &e.DurationMs, &e.Success, &e.Message); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
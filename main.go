@@ -38,6 +38,9 @@ func realMain() int {
 			"install": func() (cli.Command, error) {
 				return &InstallCommand{}, nil
 			},
+			"baseline": func() (cli.Command, error) {
+				return &BaselineCommand{}, nil
+			},
 			"up": func() (cli.Command, error) {
 				return &UpCommand{}, nil
 			},
@@ -50,15 +53,45 @@ func realMain() int {
 			"status": func() (cli.Command, error) {
 				return &StatusCommand{}, nil
 			},
+			"history": func() (cli.Command, error) {
+				return &HistoryCommand{}, nil
+			},
 			"new": func() (cli.Command, error) {
 				return &NewCommand{}, nil
 			},
+			"lint": func() (cli.Command, error) {
+				return &LintCommand{}, nil
+			},
 			"skip": func() (cli.Command, error) {
 				return &SkipCommand{}, nil
 			},
 			"seed": func() (cli.Command, error) {
 				return &SeedCommand{}, nil
 			},
+			"seed import": func() (cli.Command, error) {
+				return &SeedImportCommand{}, nil
+			},
+			"seed watch": func() (cli.Command, error) {
+				return &SeedWatchCommand{}, nil
+			},
+			"map": func() (cli.Command, error) {
+				return &MapCommand{}, nil
+			},
+			"map regions": func() (cli.Command, error) {
+				return &MapRegionsCommand{}, nil
+			},
+			"market": func() (cli.Command, error) {
+				return &MarketCommand{}, nil
+			},
+			"market orders": func() (cli.Command, error) {
+				return &MarketOrdersCommand{}, nil
+			},
+			"market depth": func() (cli.Command, error) {
+				return &MarketDepthCommand{}, nil
+			},
+			"market purge": func() (cli.Command, error) {
+				return &MarketPurgeCommand{}, nil
+			},
 			"dungeon": func() (cli.Command, error) {
 				return &DungeonCommand{}, nil
 			},
@@ -102,7 +135,7 @@ func realMain() int {
 
 	exitCode, err := cli.Run()
 	if err != nil {
-		log.Error(os.Stderr, "Error executing CLI: %s\n", err.Error())
+		log.Errorf("Error executing CLI: %s", err.Error())
 		return 1
 	}
 
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An area of the map that can be seeded: a region, a constellation or a solar system
+type SeedArea struct {
+	Kind     string `json:"kind"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	RegionID int    `json:"regionID"`
+}
+
+// Map tables searched for seed areas, from the largest area to the smallest
+var areaTables = []struct {
+	Kind    string
+	Table   string
+	IDCol   string
+	NameCol string
+	Prefix  string // Part of the seed id, regions have none to keep their original ids
+}{
+	{"region", "mapRegions", "regionID", "regionName", ""},
+	{"constellation", "mapConstellations", "constellationID", "constellationName", "CONST_"},
+	{"system", "mapSolarSystems", "solarSystemID", "solarSystemName", "SYS_"},
+}
+
+// Id of the sell order seed migration of this area
+func (a SeedArea) SeedID() string {
+	return seedID(a.idSuffix())
+}
+
+// Id of the buy order seed migration of this area
+func (a SeedArea) BuySeedID() string {
+	return buySeedID(a.idSuffix())
+}
+
+func (a SeedArea) idSuffix() string {
+	for _, t := range areaTables {
+		if t.Kind == a.Kind {
+			return t.Prefix + strconv.Itoa(a.ID)
+		}
+	}
+	return strconv.Itoa(a.ID)
+}
+
+// SQL condition selecting the stations of this area from staStations
+func (a SeedArea) StationFilter() string {
+	for _, t := range areaTables {
+		if t.Kind == a.Kind {
+			return fmt.Sprintf("%s = %d", t.IDCol, a.ID)
+		}
+	}
+	return fmt.Sprintf("regionID = %d", a.RegionID)
+}
+
+// Find a region, constellation or solar system by id or case-insensitive name.
+// Unknown names are reported with the closest names as suggestions.
+func ResolveSeedArea(db *sql.DB, value string) (*SeedArea, error) {
+	value = strings.TrimSpace(value)
+
+	for _, t := range areaTables {
+		regionCol := "regionID"
+		var query string
+		var arg interface{}
+		if id, err := strconv.Atoi(value); err == nil {
+			query = fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE %s = ?", t.IDCol, t.NameCol, regionCol, t.Table, t.IDCol)
+			arg = id
+		} else {
+			query = fmt.Sprintf("SELECT %s, %s, %s FROM %s WHERE LOWER(%s) = LOWER(?)", t.IDCol, t.NameCol, regionCol, t.Table, t.NameCol)
+			arg = value
+		}
+		log.Trace("QUERY: ", query)
+
+		area := SeedArea{Kind: t.Kind}
+		err := db.QueryRow(query, arg).Scan(&area.ID, &area.Name, &area.RegionID)
+		if err == nil {
+			return &area, nil
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("Cannot look up %s: %s", value, err)
+		}
+	}
+
+	suggestions, err := suggestAreaNames(db, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(suggestions) > 0 {
+		return nil, fmt.Errorf("Unknown region, constellation or solar system %q, did you mean: %s?", value, strings.Join(suggestions, ", "))
+	}
+	return nil, fmt.Errorf("Unknown region, constellation or solar system %q, see 'evedbtool map regions'", value)
+}
+
+// Get up to three area names close to the given one
+func suggestAreaNames(db *sql.DB, value string) ([]string, error) {
+	type candidate struct {
+		name     string
+		distance int
+	}
+
+	target := strings.ToLower(value)
+	maxDistance := len(target) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	var candidates []candidate
+	for _, t := range areaTables {
+		query := fmt.Sprintf("SELECT %s FROM %s", t.NameCol, t.Table)
+		log.Trace("QUERY: ", query)
+		rows, err := db.Query(query)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if d := levenshtein(target, strings.ToLower(name)); d <= maxDistance {
+				candidates = append(candidates, candidate{name, d})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].distance < candidates[j].distance })
+
+	var names []string
+	for i := 0; i < len(candidates) && i < 3; i++ {
+		names = append(names, candidates[i].name)
+	}
+	return names, nil
+}
+
+// Edit distance between two strings
+func levenshtein(a string, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// A region with the number of solar systems and stations it contains
+type RegionInfo struct {
+	ID       int    `json:"regionID"`
+	Name     string `json:"regionName"`
+	Systems  int    `json:"systems"`
+	Stations int    `json:"stations"`
+}
+
+// List the regions of the map
+func ListRegions(db *sql.DB) ([]RegionInfo, error) {
+	query := `SELECT r.regionID, r.regionName,
+		(SELECT COUNT(*) FROM mapSolarSystems s WHERE s.regionID = r.regionID),
+		(SELECT COUNT(*) FROM staStations st WHERE st.regionID = r.regionID)
+		FROM mapRegions r ORDER BY r.regionName`
+	log.Trace("QUERY: ", query)
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var regions []RegionInfo
+	for rows.Next() {
+		var r RegionInfo
+		if err := rows.Scan(&r.ID, &r.Name, &r.Systems, &r.Stations); err != nil {
+			return nil, err
+		}
+		regions = append(regions, r)
+	}
+	return regions, rows.Err()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/jcmturner/rpc.v1/mstypes"
+)
+
+// Number of 100 nanosecond periods in a day, the unit of issued in mktOrders
+const msEpochDay = 24 * 60 * 60 * 10000000
+
+// Filters for market orders, empty values match everything
+type OrderFilter struct {
+	Area       string // Region, constellation or solar system
+	StationID  int
+	Type       string // Type id or name
+	OwnerID    int
+	Orders     string // all, sell or buy
+	Seeded     bool   // Only orders recorded in seed_orders
+	Expired    bool   // Only orders past their duration
+	ZeroVolume bool   // Only orders without remaining volume
+	Limit      int
+}
+
+// Check whether the filter selects a part of the market, purging without one deletes everything.
+// Selecting sell or buy orders alone doesn't count, it still covers the whole side of the market.
+func (f OrderFilter) IsEmpty() bool {
+	return f.Area == "" && f.StationID == 0 && f.Type == "" && f.OwnerID == 0 &&
+		!f.Seeded && !f.Expired && !f.ZeroVolume
+}
+
+// Build the condition on mktOrders m and seed_orders so selecting the filtered orders
+func (f OrderFilter) where(db *sql.DB) (string, []interface{}, error) {
+	where := []string{"TRUE"}
+	var args []interface{}
+
+	if f.Area != "" {
+		area, err := ResolveSeedArea(db, f.Area)
+		if err != nil {
+			return "", nil, err
+		}
+		where = append(where, "m.stationID IN (SELECT stationID FROM staStations WHERE "+area.StationFilter()+")")
+	}
+	if f.StationID != 0 {
+		where = append(where, "m.stationID = ?")
+		args = append(args, f.StationID)
+	}
+	if f.Type != "" {
+		if id, err := strconv.Atoi(f.Type); err == nil {
+			where = append(where, "m.typeID = ?")
+			args = append(args, id)
+		} else {
+			where = append(where, "m.typeID IN (SELECT typeID FROM invTypes WHERE LOWER(typeName) = LOWER(?))")
+			args = append(args, f.Type)
+		}
+	}
+	if f.OwnerID != 0 {
+		where = append(where, "m.ownerID = ?")
+		args = append(args, f.OwnerID)
+	}
+	switch f.Orders {
+	case "", "all":
+	case "sell":
+		where = append(where, "m.bid = 0")
+	case "buy":
+		where = append(where, "m.bid = 1")
+	default:
+		return "", nil, fmt.Errorf("Invalid -orders %q, use all, sell or buy", f.Orders)
+	}
+	if f.Seeded {
+		where = append(where, "so.orderID IS NOT NULL")
+	}
+	if f.Expired {
+		where = append(where, fmt.Sprintf("m.issued + m.duration * %d < ?", msEpochDay))
+		args = append(args, mstypes.GetFileTime(time.Now()).MSEpoch())
+	}
+	if f.ZeroVolume {
+		where = append(where, "m.volRemaining <= 0")
+	}
+
+	return strings.Join(where, " AND "), args, nil
+}
+
+// An order of the market
+type MarketOrder struct {
+	OrderID      int       `json:"orderID"`
+	TypeID       int       `json:"typeID"`
+	TypeName     string    `json:"typeName"`
+	StationID    int       `json:"stationID"`
+	StationName  string    `json:"stationName"`
+	RegionID     int       `json:"regionID"`
+	OwnerID      int       `json:"ownerID"`
+	Bid          bool      `json:"bid"`
+	Price        float64   `json:"price"`
+	VolRemaining int       `json:"volRemaining"`
+	VolEntered   int       `json:"volEntered"`
+	Issued       time.Time `json:"issued"`
+	Duration     int       `json:"duration"`
+	SeedID       string    `json:"seedID"`
+}
+
+// List the filtered orders
+func ListOrders(db *sql.DB, filter OrderFilter) ([]MarketOrder, error) {
+	if err := ensureSeedTables(db); err != nil {
+		return nil, err
+	}
+
+	where, args, err := filter.where(db)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT m.orderID, m.typeID, COALESCE(invTypes.typeName, ''), m.stationID, COALESCE(staStations.stationName, ''),
+		m.regionID, m.ownerID, m.bid, m.price, m.volRemaining, m.volEntered, m.issued, m.duration, COALESCE(so.seedID, '')
+		FROM mktOrders m
+		LEFT JOIN ` + seedOrdersTable + ` so ON so.orderID = m.orderID
+		LEFT JOIN invTypes ON invTypes.typeID = m.typeID
+		LEFT JOIN staStations ON staStations.stationID = m.stationID
+		WHERE ` + where + ` ORDER BY m.orderID`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []MarketOrder
+	for rows.Next() {
+		var o MarketOrder
+		var issued int64
+		if err := rows.Scan(&o.OrderID, &o.TypeID, &o.TypeName, &o.StationID, &o.StationName, &o.RegionID, &o.OwnerID,
+			&o.Bid, &o.Price, &o.VolRemaining, &o.VolEntered, &issued, &o.Duration, &o.SeedID); err != nil {
+			return nil, err
+		}
+		o.Issued = msEpochTime(issued)
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// Sell and buy side of the filtered orders of a type
+type TypeDepth struct {
+	TypeID     int     `json:"typeID"`
+	TypeName   string  `json:"typeName"`
+	SellOrders int     `json:"sellOrders"`
+	SellVolume int64   `json:"sellVolume"`
+	MinSell    float64 `json:"minSell"`
+	BuyOrders  int     `json:"buyOrders"`
+	BuyVolume  int64   `json:"buyVolume"`
+	MaxBuy     float64 `json:"maxBuy"`
+}
+
+// Get the depth of the market per type for the filtered orders
+func MarketDepth(db *sql.DB, filter OrderFilter) ([]TypeDepth, error) {
+	if err := ensureSeedTables(db); err != nil {
+		return nil, err
+	}
+
+	where, args, err := filter.where(db)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT m.typeID, COALESCE(MAX(invTypes.typeName), ''),
+		SUM(m.bid = 0), COALESCE(SUM(IF(m.bid = 0, m.volRemaining, 0)), 0), COALESCE(MIN(IF(m.bid = 0, m.price, NULL)), 0),
+		SUM(m.bid = 1), COALESCE(SUM(IF(m.bid = 1, m.volRemaining, 0)), 0), COALESCE(MAX(IF(m.bid = 1, m.price, NULL)), 0)
+		FROM mktOrders m
+		LEFT JOIN ` + seedOrdersTable + ` so ON so.orderID = m.orderID
+		LEFT JOIN invTypes ON invTypes.typeID = m.typeID
+		WHERE ` + where + ` GROUP BY m.typeID ORDER BY m.typeID`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var depth []TypeDepth
+	for rows.Next() {
+		var d TypeDepth
+		if err := rows.Scan(&d.TypeID, &d.TypeName, &d.SellOrders, &d.SellVolume, &d.MinSell, &d.BuyOrders, &d.BuyVolume, &d.MaxBuy); err != nil {
+			return nil, err
+		}
+		depth = append(depth, d)
+	}
+	return depth, rows.Err()
+}
+
+// Delete the filtered orders and their seed_orders records, returning how many orders matched.
+// Seeded orders purged this way are not recreated by seed watch.
+func PurgeOrders(db *sql.DB, filter OrderFilter, dryrun bool) (int64, error) {
+	if filter.IsEmpty() {
+		return 0, fmt.Errorf("Refusing to purge the whole market, use at least one filter besides -orders")
+	}
+	if err := ensureSeedTables(db); err != nil {
+		return 0, err
+	}
+
+	where, args, err := filter.where(db)
+	if err != nil {
+		return 0, err
+	}
+	from := "FROM mktOrders m LEFT JOIN " + seedOrdersTable + " so ON so.orderID = m.orderID WHERE " + where
+
+	if dryrun {
+		var n int64
+		query := "SELECT COUNT(*) " + from
+		log.Trace("QUERY: ", query)
+		err := db.QueryRow(query, args...).Scan(&n)
+		return n, err
+	}
+
+	var n int64
+	err = GetRetryPolicy().Do("Purging market orders", func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		//The temporary table lives on the connection of the transaction, which may
+		//still hold it from a failed attempt
+		if _, err := tx.Exec("DROP TEMPORARY TABLE IF EXISTS tPurge"); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		queries := []string{
+			"CREATE TEMPORARY TABLE tPurge (orderID INT NOT NULL PRIMARY KEY) SELECT m.orderID " + from,
+			"DELETE so FROM " + seedOrdersTable + " so INNER JOIN tPurge USING (orderID)",
+			"DELETE m FROM mktOrders m INNER JOIN tPurge USING (orderID)",
+			"DROP TEMPORARY TABLE tPurge",
+		}
+		for i, query := range queries {
+			log.Trace("QUERY: ", query)
+			var res sql.Result
+			if i == 0 {
+				res, err = tx.Exec(query, args...)
+			} else {
+				res, err = tx.Exec(query)
+			}
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			if i == 0 {
+				if n, err = res.RowsAffected(); err != nil {
+					_ = tx.Rollback()
+					return err
+				}
+			}
+		}
+
+		return tx.Commit()
+	})
+
+	return n, err
+}
+
+func msEpochTime(ticks int64) time.Time {
+	hd := ticks >> 32
+	return mstypes.FileTime{LowDateTime: uint32(ticks - hd<<32), HighDateTime: uint32(hd)}.Time()
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+const verifyCommand = "-- +migrate Verify"
+const tagsCommand = "-- +tags"
+
+// Reads migration files like sql-migrate's FileMigrationSource, additionally
+// extracting the sections sql-migrate doesn't know about before parsing and
+// leaving out migrations whose tags don't match the configured environment.
+type FileSource struct {
+	Dir         string
+	Environment string
+
+	// Table tracking the applied migrations, these are never filtered out
+	DB    *sql.DB
+	Table string
+
+	// Migrations left out by their tags, with the reason why
+	Filtered map[string]string
+
+	verifications map[string][]string
+	applied       map[string]bool
+}
+
+// Environment the migration tags are matched against, config files written
+// before tags existed don't set one
+func migrationEnvironment() string {
+	if viper.IsSet("environment") {
+		return viper.GetString("environment")
+	}
+	return "production"
+}
+
+func NewFileSource(dir string) *FileSource {
+	return &FileSource{
+		Dir:           dir,
+		Environment:   migrationEnvironment(),
+		Filtered:      make(map[string]string),
+		verifications: make(map[string][]string),
+	}
+}
+
+func (s *FileSource) FindMigrations() ([]*migrate.Migration, error) {
+	items, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []*migrate.Migration
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".sql") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.Dir, item.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		//Variables are only expanded in the statements that are run, see expandPlannedMigration
+		content, verify, err := extractVerifySection(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing migration (%s): %s", item.Name(), err)
+		}
+
+		if tags := parseTags(content); !tagsMatch(tags, s.Environment) {
+			applied, err := s.isApplied(item.Name())
+			if err != nil {
+				return nil, err
+			}
+			if !applied {
+				s.Filtered[item.Name()] = fmt.Sprintf("tags %s don't match environment %q", strings.Join(tags, ","), s.Environment)
+				continue
+			}
+			log.Debug("Keeping applied migration ", item.Name(), " despite its tags")
+		}
+
+		migration, err := migrate.ParseMigration(item.Name(), bytes.NewReader([]byte(content)))
+		if err != nil {
+			return nil, err
+		}
+
+		s.verifications[migration.Id] = verify
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Less(migrations[j]) })
+
+	return migrations, nil
+}
+
+// Check whether a migration is recorded as applied in the tracking table
+func (s *FileSource) isApplied(id string) (bool, error) {
+	if s.DB == nil {
+		return false, nil
+	}
+
+	if s.applied == nil {
+		records, err := migrate.MigrationSet{TableName: s.Table}.GetMigrationRecords(s.DB, "mysql")
+		if err != nil {
+			return false, err
+		}
+		s.applied = make(map[string]bool)
+		for _, r := range records {
+			s.applied[r.Id] = true
+		}
+	}
+
+	return s.applied[id], nil
+}
+
+// Expand the variables in the statements of a planned migration that are about to run
+func expandPlannedMigration(m *migrate.PlannedMigration, dir migrate.MigrationDirection) (*migrate.PlannedMigration, error) {
+	queries, err := ExpandStatements(m.Queries)
+	if err != nil {
+		return nil, fmt.Errorf("Migration %s: %s", m.Id, err)
+	}
+
+	migration := *m.Migration
+	if dir == migrate.Up {
+		migration.Up = queries
+	} else {
+		migration.Down = queries
+	}
+	return &migrate.PlannedMigration{
+		Migration:          &migration,
+		Queries:            queries,
+		DisableTransaction: m.DisableTransaction,
+	}, nil
+}
+
+// Assertion queries to run after the Up section of a migration
+func (s *FileSource) Verifications(id string) []string {
+	return s.verifications[id]
+}
+
+// Split the Verify section from a migration, returning the remaining migration and
+// the assertion statements. The section runs until the next Up or Down section.
+func extractVerifySection(content string) (string, []string, error) {
+	var rest []string
+	var verify []string
+	inVerify := false
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, verifyCommand) {
+			inVerify = true
+			continue
+		}
+		if strings.HasPrefix(line, "-- +migrate Up") || strings.HasPrefix(line, "-- +migrate Down") {
+			inVerify = false
+		}
+
+		if inVerify {
+			verify = append(verify, line)
+		} else {
+			rest = append(rest, line)
+		}
+	}
+
+	statements, err := SplitStatements(strings.Join(verify, "\n"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return strings.Join(rest, "\n"), statements, nil
+}
+
+// Get the tags of a migration from its "-- +tags" header lines
+func parseTags(content string) []string {
+	var tags []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, tagsCommand) {
+			for _, tag := range strings.FieldsFunc(line[len(tagsCommand):], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+				tags = append(tags, strings.ToLower(tag))
+			}
+		}
+	}
+	return tags
+}
+
+// Untagged migrations run everywhere. Otherwise a migration runs if the environment
+// is one of its tags, or if it only has "!env" tags and none of them excludes it.
+func tagsMatch(tags []string, environment string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+
+	environment = strings.ToLower(environment)
+	positive := false
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "!") {
+			if tag[1:] == environment {
+				return false
+			}
+			continue
+		}
+		positive = true
+		if tag == environment {
+			return true
+		}
+	}
+
+	return !positive
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/olekukonko/tablewriter"
+)
+
+// Print rows as a table on stdout
+func PrintTable(header []string, rows [][]string) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader(header)
+	table.SetColWidth(60)
+	table.AppendBulk(rows)
+	table.Render()
+}
+
+// Print a value as indented JSON on stdout
+func PrintJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	ui.Output(string(data))
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Model used to price seeded orders, configured under seed-pricing: in evedb.yaml
+type PricingModel struct {
+	// Where base prices come from: "invTypes" for invTypes.basePrice, or "table"
+	// for a price table with one row per type, e.g. imported from external data
+	BaseSource      string `mapstructure:"base-source"`
+	BaseTable       string `mapstructure:"base-table"`
+	BaseTypeColumn  string `mapstructure:"base-type-column"`
+	BasePriceColumn string `mapstructure:"base-price-column"`
+
+	// Price used for types without a base price
+	DefaultPrice float64 `mapstructure:"default-price"`
+
+	// Multiplier by station security, the first band the security reaches applies
+	SecurityCurve []SecurityBand `mapstructure:"security-curve"`
+
+	// Multiplier by invGroups.categoryID
+	CategoryMultipliers map[string]float64 `mapstructure:"category-multipliers"`
+
+	// Random price variation, each order falls in a band chosen by its weight
+	JitterBands []JitterBand `mapstructure:"jitter-bands"`
+
+	// Limits of the final price, a ceiling of 0 means no limit
+	Floor   float64 `mapstructure:"floor"`
+	Ceiling float64 `mapstructure:"ceiling"`
+}
+
+type SecurityBand struct {
+	MinSecurity float64 `mapstructure:"min-security"`
+	Multiplier  float64 `mapstructure:"multiplier"`
+}
+
+type JitterBand struct {
+	Weight float64 `mapstructure:"weight"`
+	Min    float64 `mapstructure:"min"`
+	Max    float64 `mapstructure:"max"`
+}
+
+// Get the configured pricing model, filling in defaults for anything not configured
+func GetPricingModel() (PricingModel, error) {
+	model := PricingModel{
+		BaseSource:   "invTypes",
+		DefaultPrice: 100,
+		SecurityCurve: []SecurityBand{
+			{MinSecurity: 0.45, Multiplier: 1},
+			{MinSecurity: 0, Multiplier: 1.25},
+			{MinSecurity: -1, Multiplier: 1.5},
+		},
+		JitterBands: []JitterBand{
+			{Weight: 1, Min: -0.05, Max: 0.05},
+		},
+		Floor: 0.01,
+	}
+
+	if viper.IsSet("seed-pricing") {
+		if err := unmarshalOverDefaults("seed-pricing", &model); err != nil {
+			return model, fmt.Errorf("Invalid seed-pricing configuration: %s", err)
+		}
+	}
+
+	return model, model.validate()
+}
+
+func (p PricingModel) validate() error {
+	switch p.BaseSource {
+	case "invTypes":
+	case "table":
+		for _, name := range []string{p.BaseTable, p.BaseTypeColumn, p.BasePriceColumn} {
+			if !sqlIdentifier.MatchString(name) {
+				return fmt.Errorf("Invalid seed-pricing: base-table, base-type-column and base-price-column must be table and column names, got %q", name)
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid seed-pricing: unknown base-source %q (use invTypes or table)", p.BaseSource)
+	}
+
+	for category, multiplier := range p.CategoryMultipliers {
+		if _, err := strconv.Atoi(category); err != nil {
+			return fmt.Errorf("Invalid seed-pricing: category-multipliers keys must be category ids, got %q", category)
+		}
+		if multiplier <= 0 {
+			return fmt.Errorf("Invalid seed-pricing: multiplier of category %s must be positive", category)
+		}
+	}
+	for _, band := range p.SecurityCurve {
+		if band.Multiplier <= 0 {
+			return fmt.Errorf("Invalid seed-pricing: security-curve multipliers must be positive")
+		}
+	}
+
+	total := 0.0
+	for _, band := range p.JitterBands {
+		if band.Weight < 0 || band.Min > band.Max || band.Min <= -1 {
+			return fmt.Errorf("Invalid seed-pricing: jitter bands need a positive weight and -1 < min <= max")
+		}
+		total += band.Weight
+	}
+	if len(p.JitterBands) > 0 && total == 0 {
+		return fmt.Errorf("Invalid seed-pricing: jitter bands need a positive weight")
+	}
+
+	if p.Ceiling > 0 && p.Ceiling < p.Floor {
+		return fmt.Errorf("Invalid seed-pricing: ceiling is below the floor")
+	}
+	return nil
+}
+
+// Join adding the base price table to the seed query, if the model uses one
+func (p PricingModel) JoinClause() string {
+	if p.BaseSource != "table" {
+		return ""
+	}
+	return fmt.Sprintf("LEFT JOIN %s AS seedPrice ON seedPrice.%s = invTypes.typeID", p.BaseTable, p.BaseTypeColumn)
+}
+
+// SQL expression computing the price of an order before its random variation, from
+// the columns of invTypes, invGroups and the selected station
+func (p PricingModel) BaseExpression() string {
+	base := "invTypes.basePrice"
+	if p.BaseSource == "table" {
+		base = "seedPrice." + p.BasePriceColumn
+	}
+	price := fmt.Sprintf("COALESCE(NULLIF(%s, 0), %s)", base, formatFloat(p.DefaultPrice))
+
+	factors := []string{price}
+	if curve := p.securityExpression(); curve != "" {
+		factors = append(factors, curve)
+	}
+	if categories := p.categoryExpression(); categories != "" {
+		factors = append(factors, categories)
+	}
+	return strings.Join(factors, " * ")
+}
+
+// SQL expression computing the final price of an order from the result of BaseExpression
+// and a random number between 0 and 1. Both are expected as columns of a derived table,
+// so the random number is generated once per order.
+func (p PricingModel) PriceExpression(base string, roll string) string {
+	expr := base
+	if jitter := p.jitterExpression(roll); jitter != "" {
+		expr = fmt.Sprintf("%s * %s", base, jitter)
+	}
+
+	expr = fmt.Sprintf("GREATEST(%s, %s)", formatFloat(p.Floor), expr)
+	if p.Ceiling > 0 {
+		expr = fmt.Sprintf("LEAST(%s, %s)", formatFloat(p.Ceiling), expr)
+	}
+	return fmt.Sprintf("ROUND(%s, 2)", expr)
+}
+
+func (p PricingModel) securityExpression() string {
+	if len(p.SecurityCurve) == 0 {
+		return ""
+	}
+
+	bands := append([]SecurityBand{}, p.SecurityCurve...)
+	sort.SliceStable(bands, func(i, j int) bool { return bands[i].MinSecurity > bands[j].MinSecurity })
+
+	var b strings.Builder
+	b.WriteString("(CASE")
+	for _, band := range bands {
+		fmt.Fprintf(&b, " WHEN security >= %s THEN %s", formatFloat(band.MinSecurity), formatFloat(band.Multiplier))
+	}
+	//Below the lowest band the lowest band still applies
+	fmt.Fprintf(&b, " ELSE %s END)", formatFloat(bands[len(bands)-1].Multiplier))
+	return b.String()
+}
+
+func (p PricingModel) categoryExpression() string {
+	if len(p.CategoryMultipliers) == 0 {
+		return ""
+	}
+
+	var categories []string
+	for category := range p.CategoryMultipliers {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	var b strings.Builder
+	b.WriteString("(CASE invGroups.categoryID")
+	for _, category := range categories {
+		fmt.Fprintf(&b, " WHEN %s THEN %s", category, formatFloat(p.CategoryMultipliers[category]))
+	}
+	b.WriteString(" ELSE 1 END)")
+	return b.String()
+}
+
+// A band is picked by the random number of the order, which then also chooses the
+// variation uniformly within the band once scaled to it
+func (p PricingModel) jitterExpression(roll string) string {
+	total := 0.0
+	for _, band := range p.JitterBands {
+		total += band.Weight
+	}
+	if total == 0 {
+		return ""
+	}
+
+	var bands []JitterBand
+	for _, band := range p.JitterBands {
+		if band.Weight > 0 {
+			bands = append(bands, band)
+		}
+	}
+
+	variation := func(band JitterBand, position string) string {
+		return fmt.Sprintf("1 + %s + %s * %s", formatFloat(band.Min), position, formatFloat(math.Round((band.Max-band.Min)*1e6)/1e6))
+	}
+	if len(bands) == 1 {
+		return "(" + variation(bands[0], roll) + ")"
+	}
+
+	var b strings.Builder
+	b.WriteString("(CASE")
+	lower := 0.0
+	for i, band := range bands {
+		width := band.Weight / total
+		position := fmt.Sprintf("(%s - %s) / %s", roll, formatFloat(lower), formatFloat(width))
+		if i == len(bands)-1 {
+			fmt.Fprintf(&b, " ELSE %s END)", variation(band, position))
+			break
+		}
+		lower += width
+		fmt.Fprintf(&b, " WHEN %s < %s THEN %s", roll, formatFloat(lower), variation(band, position))
+	}
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+// A release marker: the last migration of a source that belongs to the release
+type Release struct {
+	Name      string `mapstructure:"name"`
+	Migration string `mapstructure:"migration"`
+	Source    string `mapstructure:"source"`
+}
+
+// Location of the file listing the releases
+func releasesFile() string {
+	if viper.IsSet("releases-file") {
+		return viper.GetString("releases-file")
+	}
+	return "releases.yaml"
+}
+
+// Load the releases, oldest first, as listed in the releases file.
+// Releases without a source belong to the first migration source.
+func LoadReleases() ([]Release, error) {
+	file := releasesFile()
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(file)
+	v.SetConfigType("yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Cannot read %s: %s", file, err)
+	}
+
+	var releases []Release
+	if err := v.UnmarshalKey("releases", &releases); err != nil {
+		return nil, fmt.Errorf("Invalid releases in %s: %s", file, err)
+	}
+
+	sources, err := GetMigrationSources()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for i := range releases {
+		if releases[i].Name == "" {
+			return nil, fmt.Errorf("Release %d in %s has no name", i+1, file)
+		}
+		if releases[i].Migration == "" {
+			return nil, fmt.Errorf("Release %s in %s has no migration", releases[i].Name, file)
+		}
+		if names[releases[i].Name] {
+			return nil, fmt.Errorf("Duplicate release in %s: %s", file, releases[i].Name)
+		}
+		if releases[i].Source == "" {
+			releases[i].Source = sources[0].Name
+		}
+		names[releases[i].Name] = true
+	}
+
+	return releases, nil
+}
+
+// Find a release by name
+func FindRelease(name string) (*Release, error) {
+	releases, err := LoadReleases()
+	if err != nil {
+		return nil, err
+	}
+	if releases == nil {
+		return nil, fmt.Errorf("No releases defined, create %s first", releasesFile())
+	}
+
+	for i := range releases {
+		if releases[i].Name == name {
+			return &releases[i], nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown release: %s", name)
+}
+
+// Get the newest release whose marker migration is applied, nil if there is none
+func CurrentRelease(db *sql.DB, releases []Release) (*Release, error) {
+	sources, err := GetMigrationSources()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[string]map[string]bool)
+	for _, s := range sources {
+		records, err := s.Set().GetMigrationRecords(db, "mysql")
+		if err != nil {
+			return nil, err
+		}
+		applied[s.Name] = make(map[string]bool)
+		for _, r := range records {
+			applied[s.Name][r.Id] = true
+		}
+	}
+
+	var current *Release
+	for i := range releases {
+		if applied[releases[i].Source][releases[i].Migration] {
+			current = &releases[i]
+		}
+	}
+	return current, nil
+}
+
+// Limit planned migrations to those that move a source to the target migration:
+// on Up the ones up to and including it, on Down the ones newer than it
+func limitToTarget(migrations []*migrate.PlannedMigration, dir migrate.MigrationDirection, target string) []*migrate.PlannedMigration {
+	marker := &migrate.Migration{Id: target}
+
+	var result []*migrate.PlannedMigration
+	for _, m := range migrations {
+		if dir == migrate.Up && !marker.Less(m.Migration) {
+			result = append(result, m)
+		}
+		if dir == migrate.Down && marker.Less(m.Migration) {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Check that a source has a migration with the given id
+func checkMigrationExists(source migrate.MigrationSource, id string) error {
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Id == id {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown migration: %s", id)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Table tracking the checksum of every applied repeatable migration
+const repeatableTable = "repeatable_migrations"
+
+// A migration that is re-applied whenever its definition changes,
+// used for views, stored procedures and triggers
+type RepeatableMigration struct {
+	Id         string
+	Path       string
+	Checksum   string
+	Statements []string
+}
+
+// Directory holding the repeatable migrations
+func repeatableDir() string {
+	if viper.IsSet("repeatable-dir") {
+		return viper.GetString("repeatable-dir")
+	}
+	return "repeatable"
+}
+
+// Read all repeatable migrations, ordered by file name (as returned by ReadDir).
+// A missing directory simply means there are none.
+func FindRepeatableMigrations() ([]*RepeatableMigration, error) {
+	dir := repeatableDir()
+	items, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var migrations []*RepeatableMigration
+	for _, item := range items {
+		if item.IsDir() || !strings.HasSuffix(item.Name(), ".sql") {
+			continue
+		}
+
+		path := filepath.Join(dir, item.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		//The checksum covers the expanded SQL, so changing a variable re-applies the migration
+		expanded, err := ExpandVars(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing repeatable migration (%s): %s", item.Name(), err)
+		}
+
+		statements, err := SplitStatements(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing repeatable migration (%s): %s", item.Name(), err)
+		}
+
+		sum := sha256.Sum256([]byte(expanded))
+		migrations = append(migrations, &RepeatableMigration{
+			Id:         item.Name(),
+			Path:       path,
+			Checksum:   hex.EncodeToString(sum[:]),
+			Statements: statements,
+		})
+	}
+
+	return migrations, nil
+}
+
+func ensureRepeatableTable(db *sql.DB) error {
+	query := `CREATE TABLE IF NOT EXISTS ` + repeatableTable + ` (
+		id VARCHAR(255) NOT NULL,
+		checksum CHAR(64) NOT NULL,
+		applied_at DATETIME NOT NULL,
+		PRIMARY KEY (id)
+	)`
+	log.Trace("QUERY: ", query)
+	_, err := db.Exec(query)
+	return err
+}
+
+// Get the applied repeatable migrations with their checksum and time of application
+func GetRepeatableRecords(db *sql.DB) (map[string]string, map[string]time.Time, error) {
+	if err := ensureRepeatableTable(db); err != nil {
+		return nil, nil, err
+	}
+
+	query := `SELECT id, checksum, applied_at FROM ` + repeatableTable
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	checksums := make(map[string]string)
+	appliedAt := make(map[string]time.Time)
+	for rows.Next() {
+		var id, checksum string
+		var at time.Time
+		if err := rows.Scan(&id, &checksum, &at); err != nil {
+			return nil, nil, err
+		}
+		checksums[id] = checksum
+		appliedAt[id] = at
+	}
+
+	return checksums, appliedAt, rows.Err()
+}
+
+// Get the repeatable migrations that are new or changed since they were last applied
+func PlanRepeatableMigrations(db *sql.DB) ([]*RepeatableMigration, error) {
+	migrations, err := FindRepeatableMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	checksums, _, err := GetRepeatableRecords(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var planned []*RepeatableMigration
+	for _, m := range migrations {
+		if checksums[m.Id] != m.Checksum {
+			planned = append(planned, m)
+		}
+	}
+	return planned, nil
+}
+
+// Run all statements of a repeatable migration in a transaction on a single connection and record its checksum
+func ApplyRepeatableMigration(db *sql.DB, m *RepeatableMigration) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	//DDL commits implicitly, only migrations changing data are rolled back on failure
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range m.Statements {
+		log.Trace("QUERY: ", stmt)
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	query := `INSERT INTO ` + repeatableTable + ` (id, checksum, applied_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE checksum = VALUES(checksum), applied_at = VALUES(applied_at)`
+	log.Trace("QUERY: ", query)
+	if _, err := tx.ExecContext(ctx, query, m.Id, m.Checksum, time.Now()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+// MySQL server errors after which the failed statement or transaction had no effect
+var retryableErrors = map[uint16]string{
+	1040: "too many connections",
+	1205: "lock wait timeout",
+	1213: "deadlock",
+}
+
+// MySQL server errors that end the connection, possibly after the statement ran
+var connectionErrors = map[uint16]string{
+	1053: "server shutdown in progress",
+}
+
+// Statements MySQL rolls back with their transaction. Anything else, DDL in
+// particular, commits implicitly and can't simply be run again after a failure.
+var transactionalStatement = regexp.MustCompile(`(?is)^(INSERT|UPDATE|DELETE|REPLACE|SELECT)\s`)
+
+// Exponential backoff used to retry statements on transient database errors
+type RetryPolicy struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+	Multiplier      float64
+	Jitter          float64 // Randomization of each interval, as a fraction of it
+}
+
+// Get the retry policy configured under retry: in evedb.yaml
+func GetRetryPolicy() RetryPolicy {
+	policy := RetryPolicy{
+		InitialInterval: 500 * time.Millisecond,
+		MaxInterval:     30 * time.Second,
+		MaxElapsedTime:  5 * time.Minute,
+		Multiplier:      2,
+		Jitter:          0.2,
+	}
+
+	if viper.IsSet("retry.initial-interval") {
+		policy.InitialInterval = viper.GetDuration("retry.initial-interval")
+	}
+	if viper.IsSet("retry.max-interval") {
+		policy.MaxInterval = viper.GetDuration("retry.max-interval")
+	}
+	if viper.IsSet("retry.max-elapsed-time") {
+		policy.MaxElapsedTime = viper.GetDuration("retry.max-elapsed-time")
+	}
+	if viper.IsSet("retry.multiplier") {
+		policy.Multiplier = viper.GetFloat64("retry.multiplier")
+	}
+	if viper.IsSet("retry.jitter") {
+		policy.Jitter = viper.GetFloat64("retry.jitter")
+	}
+
+	return policy
+}
+
+// Run an operation, retrying it while it fails with an error that guarantees it had
+// no effect and the maximum elapsed time hasn't been reached
+func (p RetryPolicy) Do(what string, op func() error) error {
+	return p.retry(what, op, IsRetryableError)
+}
+
+// Run an idempotent operation, like connecting, which is also retried when the
+// connection is lost
+func (p RetryPolicy) DoIdempotent(what string, op func() error) error {
+	return p.retry(what, op, func(err error) bool {
+		return IsRetryableError(err) || IsConnectionLost(err)
+	})
+}
+
+// Run an operation that is retried like Do, and also when the connection is lost
+// and applied reports that it didn't take effect before
+func (p RetryPolicy) DoVerified(what string, op func() error, applied func() (bool, error)) error {
+	return p.retry(what, func() error {
+		err := op()
+		if err == nil || !IsConnectionLost(err) {
+			return err
+		}
+
+		if err := waitForDB(); err != nil {
+			return err
+		}
+		done, checkErr := applied()
+		if checkErr != nil {
+			return fmt.Errorf("%s (cannot check whether it took effect: %s)", err, checkErr)
+		}
+		if done {
+			log.Warn(what, " took effect before the connection was lost")
+			return nil
+		}
+		return &notAppliedError{Err: err}
+	}, func(err error) bool {
+		var notApplied *notAppliedError
+		return IsRetryableError(err) || errors.As(err, &notApplied)
+	})
+}
+
+// A lost connection after which the operation was found not to have taken effect
+type notAppliedError struct {
+	Err error
+}
+
+func (e *notAppliedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *notAppliedError) Unwrap() error {
+	return e.Err
+}
+
+func (p RetryPolicy) retry(what string, op func() error, retryable func(error) bool) error {
+	start := time.Now()
+	interval := p.InitialInterval
+	attempt := 1
+
+	for {
+		err := op()
+		if err == nil || !retryable(err) {
+			return err
+		}
+
+		wait := p.jittered(interval)
+		if time.Since(start)+wait > p.MaxElapsedTime {
+			return fmt.Errorf("%s (gave up after %d attempts)", err, attempt)
+		}
+
+		log.Warn(what, " failed (attempt ", attempt, "), retrying in ", wait.Round(time.Millisecond), "; ", err)
+		time.Sleep(wait)
+
+		attempt++
+		interval = time.Duration(float64(interval) * p.Multiplier)
+		if interval > p.MaxInterval {
+			interval = p.MaxInterval
+		}
+	}
+}
+
+func (p RetryPolicy) jittered(interval time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return interval
+	}
+	delta := p.Jitter * float64(interval)
+	return time.Duration(float64(interval) - delta + rand.Float64()*2*delta)
+}
+
+// Check whether an error guarantees the failed statement or transaction had no effect:
+// a deadlock, a lock wait timeout, or a connection that failed before anything was sent
+func IsRetryableError(err error) bool {
+	var txErr *migrate.TxError
+	if errors.As(err, &txErr) {
+		err = txErr.Err
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		_, ok := retryableErrors[mysqlErr.Number]
+		return ok
+	}
+
+	return errors.Is(err, driver.ErrBadConn)
+}
+
+// Check whether the connection was lost, possibly after the server ran the statement
+// or the commit. Whether it took effect has to be checked before running it again.
+func IsConnectionLost(err error) bool {
+	var txErr *migrate.TxError
+	if errors.As(err, &txErr) {
+		err = txErr.Err
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		_, ok := connectionErrors[mysqlErr.Number]
+		return ok
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Wait until the database accepts connections again, following the retry policy
+func waitForDB() error {
+	return GetRetryPolicy().DoIdempotent("Connecting to the database", func() error {
+		db := getDB()
+		defer db.Close()
+		return db.Ping()
+	})
+}
+
+// Execute a single statement, retrying it on errors that guarantee it had no effect
+func execWithRetry(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := GetRetryPolicy().Do("Statement", func() error {
+		var err error
+		result, err = db.Exec(query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Run a function in a transaction, retrying the whole transaction on errors that roll it
+// back. When the connection is lost, it is only retried if applied reports that the
+// transaction wasn't committed; without applied it isn't retried then.
+func inTransaction(db *sql.DB, what string, op func(tx *sql.Tx) error, applied func() (bool, error)) error {
+	run := func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := op(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	if applied == nil {
+		return GetRetryPolicy().Do(what, run)
+	}
+	return GetRetryPolicy().DoVerified(what, run, applied)
+}
+
+// Check whether statements only change data, so a transaction running them
+// can be rolled back and retried as a whole
+func IsTransactional(statements []string) bool {
+	for _, stmt := range statements {
+		if !transactionalStatement.MatchString(stripLeadingComments(stmt)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove the comments in front of a statement. Conditional /*! comments are
+// executed by MySQL, so they are kept.
+func stripLeadingComments(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "--"), strings.HasPrefix(stmt, "#"):
+			end := strings.Index(stmt, "\n")
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+1:]
+		case strings.HasPrefix(stmt, "/*") && !strings.HasPrefix(stmt, "/*!"):
+			end := strings.Index(stmt, "*/")
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+2:]
+		default:
+			return stmt
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const identifier = "(`[^`]+`|[A-Za-z0-9_$.]+)"
+
+var (
+	createTablePattern   = regexp.MustCompile(`(?is)^CREATE\s+(?:TEMPORARY\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + identifier)
+	createViewPattern    = regexp.MustCompile(`(?is)^CREATE\s+(?:ALGORITHM\s*=\s*\w+\s+)?(?:DEFINER\s*=\s*\S+\s+)?(?:SQL\s+SECURITY\s+\w+\s+)?VIEW\s+` + identifier)
+	createIndexPattern   = regexp.MustCompile(`(?is)^CREATE\s+(?:UNIQUE\s+|FULLTEXT\s+|SPATIAL\s+)?INDEX\s+` + identifier + `\s+ON\s+` + identifier)
+	createRoutinePattern = regexp.MustCompile(`(?is)^CREATE\s+(?:DEFINER\s*=\s*\S+\s+)?(PROCEDURE|FUNCTION|TRIGGER)\s+(?:IF\s+NOT\s+EXISTS\s+)?` + identifier)
+	renameTablePattern   = regexp.MustCompile(`(?is)^RENAME\s+TABLE\s+(.+)$`)
+	renamePairPattern    = regexp.MustCompile(`(?is)^` + identifier + `\s+TO\s+` + identifier + `$`)
+	alterTablePattern    = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+` + identifier + `\s+(.+)$`)
+
+	addIndexPattern      = regexp.MustCompile(`(?is)^ADD\s+(?:UNIQUE\s+(?:INDEX\s+|KEY\s+)?|FULLTEXT\s+(?:INDEX\s+|KEY\s+)?|SPATIAL\s+(?:INDEX\s+|KEY\s+)?|INDEX\s+|KEY\s+)` + identifier + `\s*\(`)
+	addPrimaryPattern    = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT\s+(?:` + identifier + `\s+)?)?PRIMARY\s+KEY`)
+	addForeignPattern    = regexp.MustCompile(`(?is)^ADD\s+CONSTRAINT\s+` + identifier + `\s+FOREIGN\s+KEY`)
+	addColumnPattern     = regexp.MustCompile(`(?is)^ADD\s+(?:COLUMN\s+)?` + identifier + `\s+\w`)
+	renameToPattern      = regexp.MustCompile(`(?is)^RENAME\s+(?:TO\s+|AS\s+)?` + identifier + `$`)
+	renameColumnPattern  = regexp.MustCompile(`(?is)^RENAME\s+COLUMN\s+` + identifier + `\s+TO\s+` + identifier + `$`)
+	renameIndexPattern   = regexp.MustCompile(`(?is)^RENAME\s+(INDEX|KEY)\s+` + identifier + `\s+TO\s+` + identifier + `$`)
+	createOrReplaceCheck = regexp.MustCompile(`(?is)^CREATE\s+OR\s+REPLACE\s`)
+)
+
+// Generate Down statements undoing the given Up statements, in reverse order.
+// Statements that can't be reversed automatically are returned separately.
+func ReverseStatements(up []string) ([]string, []string) {
+	var down []string
+	var unreversible []string
+
+	for i := len(up) - 1; i >= 0; i-- {
+		stmt := strings.TrimSpace(up[i])
+		stmt = strings.TrimSpace(strings.TrimSuffix(stmt, ";"))
+		if stmt == "" {
+			continue
+		}
+
+		if reversed, ok := reverseStatement(stmt); ok {
+			down = append(down, reversed)
+		} else {
+			unreversible = append(unreversible, stmt)
+		}
+	}
+
+	return down, unreversible
+}
+
+func reverseStatement(stmt string) (string, bool) {
+	//Replacing an existing definition loses the previous one
+	if createOrReplaceCheck.MatchString(stmt) {
+		return "", false
+	}
+
+	if m := createTablePattern.FindStringSubmatch(stmt); m != nil {
+		return fmt.Sprintf("DROP TABLE IF EXISTS %s", m[1]), true
+	}
+	if m := createViewPattern.FindStringSubmatch(stmt); m != nil {
+		return fmt.Sprintf("DROP VIEW IF EXISTS %s", m[1]), true
+	}
+	if m := createIndexPattern.FindStringSubmatch(stmt); m != nil {
+		return fmt.Sprintf("DROP INDEX %s ON %s", m[1], m[2]), true
+	}
+	if m := createRoutinePattern.FindStringSubmatch(stmt); m != nil {
+		return fmt.Sprintf("DROP %s IF EXISTS %s", strings.ToUpper(m[1]), m[2]), true
+	}
+	if m := renameTablePattern.FindStringSubmatch(stmt); m != nil {
+		pairs := splitTopLevel(m[1])
+		var reversed []string
+		for i := len(pairs) - 1; i >= 0; i-- {
+			p := renamePairPattern.FindStringSubmatch(strings.TrimSpace(pairs[i]))
+			if p == nil {
+				return "", false
+			}
+			reversed = append(reversed, fmt.Sprintf("%s TO %s", p[2], p[1]))
+		}
+		return "RENAME TABLE " + strings.Join(reversed, ", "), true
+	}
+	if m := alterTablePattern.FindStringSubmatch(stmt); m != nil {
+		return reverseAlterTable(m[1], m[2])
+	}
+
+	return "", false
+}
+
+// Reverse every action of an ALTER TABLE, all of them have to be reversible
+func reverseAlterTable(table string, actions string) (string, bool) {
+	var reversed []string
+	renamedTo := table
+
+	parts := splitTopLevel(actions)
+	for i := len(parts) - 1; i >= 0; i-- {
+		action := strings.TrimSpace(parts[i])
+
+		if m := renameToPattern.FindStringSubmatch(action); m != nil && !renameColumnPattern.MatchString(action) && !renameIndexPattern.MatchString(action) {
+			//The table has a new name once the statement ran
+			renamedTo = m[1]
+			reversed = append(reversed, "RENAME TO "+table)
+		} else if m := renameColumnPattern.FindStringSubmatch(action); m != nil {
+			reversed = append(reversed, fmt.Sprintf("RENAME COLUMN %s TO %s", m[2], m[1]))
+		} else if m := renameIndexPattern.FindStringSubmatch(action); m != nil {
+			reversed = append(reversed, fmt.Sprintf("RENAME %s %s TO %s", strings.ToUpper(m[1]), m[3], m[2]))
+		} else if addPrimaryPattern.MatchString(action) {
+			reversed = append(reversed, "DROP PRIMARY KEY")
+		} else if m := addForeignPattern.FindStringSubmatch(action); m != nil {
+			reversed = append(reversed, "DROP FOREIGN KEY "+m[1])
+		} else if m := addIndexPattern.FindStringSubmatch(action); m != nil {
+			reversed = append(reversed, "DROP INDEX "+m[1])
+		} else if m := addColumnPattern.FindStringSubmatch(action); m != nil && !isReservedAddKeyword(m[1]) {
+			reversed = append(reversed, "DROP COLUMN "+m[1])
+		} else {
+			return "", false
+		}
+	}
+
+	//A rename is reversed first, so the other actions refer to the original name again
+	return fmt.Sprintf("ALTER TABLE %s %s", renamedTo, strings.Join(reversed, ", ")), true
+}
+
+// Keywords that can follow ADD but don't start a column definition
+func isReservedAddKeyword(word string) bool {
+	switch strings.ToUpper(word) {
+	case "CONSTRAINT", "INDEX", "KEY", "UNIQUE", "PRIMARY", "FOREIGN", "FULLTEXT", "SPATIAL", "CHECK", "PARTITION", "COLUMN":
+		return true
+	}
+	return false
+}
+
+// Split a list on commas that are not inside parentheses or quotes
+func splitTopLevel(list string) []string {
+	var parts []string
+	var buf strings.Builder
+	depth := 0
+	var quote rune
+
+	for _, r := range list {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts = append(parts, buf.String())
+			buf.Reset()
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	if strings.TrimSpace(buf.String()) != "" {
+		parts = append(parts, buf.String())
+	}
+
+	return parts
+}
+
+// Build the lines of a Down section reversing the given Up statements.
+// Statements that can't be reversed are left as TODO comments.
+func BuildDownSection(up []string) ([]string, int) {
+	down, unreversible := ReverseStatements(up)
+
+	var lines []string
+	for _, stmt := range unreversible {
+		lines = append(lines, "-- TODO: cannot be reversed automatically: "+summarizeStatement(stmt))
+	}
+	for _, stmt := range down {
+		lines = append(lines, stmt+";")
+	}
+
+	return lines, len(unreversible)
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-gorp/gorp/v3"
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+	"gopkg.in/jcmturner/rpc.v1/mstypes"
+)
+
+const seedTable = "seed_migrations"
+
+// Orders inserted by each seed migration, so the seed can be removed again
+const seedOrdersTable = "seed_orders"
+
+// RNG seed each seed migration was built with, so its orders can be reproduced
+const seedRunsTable = "seed_runs"
+
+// Id of the single migration that seeded all regions before seeds were tracked per region
+const legacySeedID = "SEED_MARKET"
+
+// Seed migrations are created from the configuration, so records of regions that
+// are no longer configured are expected
+func seedSet() migrate.MigrationSet {
+	return migrate.MigrationSet{TableName: seedTable, IgnoreUnknown: true}
+}
+
+// Plan seed migrations by their own records. sql-migrate plans relative to the newest
+// applied migration, which doesn't work for seeds added and removed per region.
+func planSeedMigrations(db *sql.DB, migrations []*migrate.Migration, dir migrate.MigrationDirection) ([]*migrate.PlannedMigration, *gorp.DbMap, error) {
+	//This also creates the tracking table
+	records, err := seedSet().GetMigrationRecords(db, "mysql")
+	if err != nil {
+		return nil, nil, err
+	}
+	applied := make(map[string]bool)
+	for _, r := range records {
+		applied[r.Id] = true
+	}
+
+	dbMap := &gorp.DbMap{Db: db, Dialect: migrate.MigrationDialects["mysql"]}
+	dbMap.AddTableWithName(migrate.MigrationRecord{}, seedTable).SetKeys(false, "Id")
+
+	var planned []*migrate.PlannedMigration
+	for _, m := range migrations {
+		if dir == migrate.Up && !applied[m.Id] {
+			planned = append(planned, &migrate.PlannedMigration{Migration: m, Queries: m.Up, DisableTransaction: m.DisableTransactionUp})
+		}
+		if dir == migrate.Down && applied[m.Id] {
+			planned = append(planned, &migrate.PlannedMigration{Migration: m, Queries: m.Down, DisableTransaction: m.DisableTransactionDown})
+		}
+	}
+
+	return planned, dbMap, nil
+}
+
+func seedID(regionID string) string {
+	return legacySeedID + "_" + regionID
+}
+
+// Random numbers of a seed migration, derived from the RNG seed of the run and the
+// migration id so adding an area doesn't change the orders of the others
+func seedRand(rngSeed int64, id string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return rand.New(rand.NewSource(rngSeed ^ int64(h.Sum64())))
+}
+
+// Pick a percentage of the stations of an area matching the station filters of the profile,
+// the same ones for the same random numbers, and add the stations the profile includes
+func sampleStations(db *sql.DB, area *SeedArea, profile *SeedProfile, saturation int, rng *rand.Rand) ([]int, error) {
+	stations, err := queryStations(db, area, profile.StationCondition)
+	if err != nil {
+		return nil, err
+	}
+
+	rng.Shuffle(len(stations), func(i, j int) { stations[i], stations[j] = stations[j], stations[i] })
+	stations = stations[:int(math.Round(float64(len(stations)*saturation)/100))]
+
+	if len(profile.IncludeStations) > 0 {
+		//Excluding a station wins over including it
+		condition := fmt.Sprintf("stationID IN (%s)", joinInts(profile.IncludeStations))
+		if len(profile.ExcludeStations) > 0 {
+			condition += fmt.Sprintf(" AND stationID NOT IN (%s)", joinInts(profile.ExcludeStations))
+		}
+		included, err := queryStations(db, area, condition)
+		if err != nil {
+			return nil, err
+		}
+		stations = append(stations, included...)
+	}
+
+	//A station is only seeded once, even if it was both sampled and included
+	seen := make(map[int]bool)
+	unique := stations[:0]
+	for _, id := range stations {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Ints(unique)
+	return unique, nil
+}
+
+func queryStations(db *sql.DB, area *SeedArea, condition string) ([]int, error) {
+	query := fmt.Sprintf("SELECT stationID FROM staStations WHERE %s AND %s ORDER BY stationID", area.StationFilter(), condition)
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the stations of %s: %s", area.Name, err)
+	}
+	defer rows.Close()
+
+	var stations []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		stations = append(stations, id)
+	}
+	return stations, rows.Err()
+}
+
+// SQL expression giving a random number between 0 and 1 for each station and type of the
+// seed statements. It is hashed from the salt, so the same salt gives every order the
+// same number whatever order MySQL processes the rows in.
+func seedRandom(salt string, use string) string {
+	//The first 13 hex digits of the hash are 52 random bits
+	return fmt.Sprintf("(CONV(LEFT(SHA2(CONCAT('%s:%s:', tStations.stationID, ':', invTypes.typeID), 256), 13), 16, 10) / 4503599627370496)", salt, use)
+}
+
+// Create seed_orders and seed_runs
+func ensureSeedTables(db *sql.DB) error {
+	query := "CREATE TABLE IF NOT EXISTS " + seedOrdersTable + ` (
+		orderID INT NOT NULL PRIMARY KEY,
+		seedID VARCHAR(64) NOT NULL,
+		typeID INT NOT NULL,
+		stationID INT NOT NULL,
+		bid TINYINT NOT NULL,
+		volEntered INT NOT NULL,
+		KEY seedID (seedID)
+	)`
+	log.Trace("QUERY: ", query)
+	if _, err := execWithRetry(db, query); err != nil {
+		return fmt.Errorf("Cannot create %s table: %s", seedOrdersTable, err)
+	}
+
+	query = "CREATE TABLE IF NOT EXISTS " + seedRunsTable + ` (
+		seedID VARCHAR(64) NOT NULL PRIMARY KEY,
+		rngSeed BIGINT NOT NULL
+	)`
+	log.Trace("QUERY: ", query)
+	if _, err := execWithRetry(db, query); err != nil {
+		return fmt.Errorf("Cannot create %s table: %s", seedRunsTable, err)
+	}
+
+	return nil
+}
+
+// Build the sell order seed migration of a region, constellation or solar system. Up inserts
+// the orders and records them in seed_orders, Down deletes exactly the orders recorded by Up.
+// The same RNG seed always selects the same stations and prices.
+func BuildSeedMigration(db *sql.DB, area *SeedArea, profile *SeedProfile, rngSeed int64) (*migrate.Migration, error) {
+	pricing, err := GetPricingModel()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]string{
+		"base_price":  pricing.BaseExpression(),
+		"price":       pricing.PriceExpression("basePrice", "roll"),
+		"price_join":  pricing.JoinClause(),
+		"type_filter": profile.TypeCondition,
+	}
+
+	return buildSeedMigration(db, area.SeedID(), area, profile, profile.Saturation, rngSeed, seedSellStatements, vars)
+}
+
+// Build a seed migration from statement templates, which are run after a percentage
+// of the stations of the area has been sampled into tStations
+func buildSeedMigration(db *sql.DB, id string, area *SeedArea, profile *SeedProfile, saturation int, rngSeed int64, templates []string, extra map[string]string) (*migrate.Migration, error) {
+	log.Debug("Building migration ", id, " for ", area.Kind, " ", area.Name, " with RNG seed ", rngSeed)
+
+	rng := seedRand(rngSeed, id)
+	stations, err := sampleStations(db, area, profile, saturation, rng)
+	if err != nil {
+		return nil, err
+	}
+	stationFilter := "FALSE"
+	if len(stations) > 0 {
+		stationFilter = "stationID IN (" + joinInts(stations) + ")"
+	}
+
+	//Generate a Microsoft timestamp
+	tstamp := mstypes.GetFileTime(time.Now()).MSEpoch()
+
+	vars := map[string]string{
+		"seed_id":        id,
+		"region_id":      strconv.Itoa(area.RegionID),
+		"station_filter": stationFilter,
+		"timestamp":      strconv.FormatInt(tstamp, 10),
+		"rng_seed":       strconv.FormatInt(rngSeed, 10),
+	}
+	salt := strconv.FormatInt(rng.Int63(), 10)
+	vars["roll"] = seedRandom(salt, "price")
+	vars["volume_roll"] = seedRandom(salt, "volume")
+	for name, value := range extra {
+		vars[name] = value
+	}
+
+	statements := append([]string{}, seedStationStatements...)
+	statements = append(statements, templates...)
+	statements = append(statements, seedTrackStatement, seedRunStatement, "DROP TEMPORARY TABLE IF EXISTS tStations")
+
+	var up []string
+	for _, stmt := range statements {
+		expanded, err := ExpandVarsWith(stmt, vars)
+		if err != nil {
+			return nil, err
+		}
+		up = append(up, expanded)
+	}
+
+	var down []string
+	for _, stmt := range seedDownStatements {
+		expanded, err := ExpandVarsWith(stmt, vars)
+		if err != nil {
+			return nil, err
+		}
+		down = append(down, expanded)
+	}
+
+	return &migrate.Migration{
+		Id:   id,
+		Up:   up,
+		Down: down,
+	}, nil
+}
+
+// Select the sampled stations of the area into tStations
+var seedStationStatements = []string{
+	"SET @regionid=${region_id}",
+	"SELECT COALESCE(MAX(orderID), 0) INTO @lastorder FROM mktOrders",
+	"CREATE TEMPORARY TABLE IF NOT EXISTS tStations (stationId int, solarSystemID int, regionID int, corporationID int, security float)",
+	"DELETE FROM tStations",
+	"INSERT INTO tStations SELECT stationID, solarSystemID, regionID, corporationID, security FROM staStations WHERE ${station_filter} ORDER BY stationID",
+}
+
+// The random number of an order is hashed from its station and type in the derived table
+// and priced from there, so the same RNG seed always gives the same prices
+var seedSellStatements = []string{
+	`INSERT INTO mktOrders (typeID, ownerID, regionID, stationID, price, volEntered, volRemaining, issued, minVolume, duration, solarSystemID, jumps)
+	SELECT typeID, corporationID, regionID, stationID, ${price}, 550, 550, ${timestamp}, 1, 250, solarSystemID, 1
+	FROM (SELECT invTypes.typeID, corporationID, regionID, tStations.stationID, solarSystemID, ${base_price} AS basePrice, ${roll} AS roll
+		FROM tStations, invTypes INNER JOIN invGroups USING (groupID) ${price_join}
+		WHERE ${type_filter}) AS seedRows
+	ORDER BY stationID, typeID`,
+}
+
+// Record the orders inserted since the stations were selected
+var seedTrackStatement = "INSERT INTO " + seedOrdersTable + " (orderID, seedID, typeID, stationID, bid, volEntered) SELECT orderID, '${seed_id}', typeID, stationID, bid, volEntered FROM mktOrders WHERE orderID > @lastorder AND regionID=@regionid AND issued=${timestamp}"
+
+// Record the RNG seed the migration was built with
+var seedRunStatement = "REPLACE INTO " + seedRunsTable + " (seedID, rngSeed) VALUES ('${seed_id}', ${rng_seed})"
+
+var seedDownStatements = []string{
+	"DELETE mktOrders FROM mktOrders INNER JOIN " + seedOrdersTable + " USING (orderID) WHERE seedID = '${seed_id}'",
+	"DELETE FROM " + seedOrdersTable + " WHERE seedID = '${seed_id}'",
+	"DELETE FROM " + seedRunsTable + " WHERE seedID = '${seed_id}'",
+}
+
+// Apply the seed migrations that aren't applied yet, returning the ids of those applied
+func ApplySeeds(db *sql.DB, migrations []*migrate.Migration, dryrun bool) ([]string, error) {
+	planned, _, err := planSeedMigrations(db, migrations, migrate.Up)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot plan seed migrations: %s", err)
+	}
+
+	if dryrun {
+		for _, m := range planned {
+			PrintMigration(m, migrate.Up)
+		}
+		return nil, nil
+	}
+
+	if err := ensureSeedTables(db); err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, m := range planned {
+		log.Info("Seeding ", m.Id)
+		entry := NewHistoryEntry("seed", "up", "seed", m.Id)
+		err := applySeedMigration(db, migrate.Up, m)
+		entry.Finish(err)
+		RecordHistory(db, entry)
+		if err != nil {
+			return applied, fmt.Errorf("Seeding %s failed and was rolled back: %s", m.Id, err)
+		}
+		applied = append(applied, m.Id)
+	}
+
+	return applied, nil
+}
+
+// Run the Down section of an applied seed migration, deleting the orders it inserted
+func RemoveSeed(db *sql.DB, m *migrate.Migration, command string, dryrun bool) error {
+	planned, _, err := planSeedMigrations(db, []*migrate.Migration{m}, migrate.Down)
+	if err != nil {
+		return fmt.Errorf("Cannot plan removal of %s: %s", m.Id, err)
+	}
+	if len(planned) == 0 {
+		return fmt.Errorf("%s is not applied", m.Id)
+	}
+
+	if dryrun {
+		PrintMigration(planned[0], migrate.Down)
+		return nil
+	}
+
+	if err := ensureSeedTables(db); err != nil {
+		return err
+	}
+
+	entry := NewHistoryEntry(command, "down", "seed", m.Id)
+	err = applySeedMigration(db, migrate.Down, planned[0])
+	entry.Finish(err)
+	RecordHistory(db, entry)
+	if err != nil {
+		return fmt.Errorf("Removing %s failed and was rolled back: %s", m.Id, err)
+	}
+	return nil
+}
+
+// Longest part of a failed statement shown in errors, seed statements can list thousands of stations
+const maxStatementLength = 500
+
+// A statement of a seed migration failed, the migration was rolled back
+type SeedStatementError struct {
+	Migration string
+	Index     int // 1-based position in the Up or Down section
+	Statement string
+	Err       error
+}
+
+func (e *SeedStatementError) Error() string {
+	stmt := strings.TrimSpace(e.Statement)
+	if len(stmt) > maxStatementLength {
+		stmt = stmt[:maxStatementLength] + "..."
+	}
+	return fmt.Sprintf("Statement %d failed: %s\n%s", e.Index, e.Err, stmt)
+}
+
+func (e *SeedStatementError) Unwrap() error {
+	return e.Err
+}
+
+// Run a planned seed migration and update its record in a single transaction on a
+// dedicated connection, so a failure leaves neither orders nor a record behind.
+// Errors that roll it back retry the whole migration, after a lost connection it is
+// only retried if its record shows it wasn't committed.
+func applySeedMigration(db *sql.DB, dir migrate.MigrationDirection, m *migrate.PlannedMigration) error {
+	return GetRetryPolicy().DoVerified("Seed "+m.Id, func() error {
+		return execSeedMigration(context.Background(), db, dir, m)
+	}, func() (bool, error) {
+		applied, err := IsSeedApplied(db, m.Id)
+		return applied == (dir == migrate.Up), err
+	})
+}
+
+func execSeedMigration(ctx context.Context, db *sql.DB, dir migrate.MigrationDirection, m *migrate.PlannedMigration) error {
+	//The temporary tables of the seed statements belong to this connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	fail := func(err error) error {
+		_ = tx.Rollback()
+		//The connection goes back to the pool, don't leave the stations of a failed seed on it
+		if _, dropErr := conn.ExecContext(ctx, "DROP TEMPORARY TABLE IF EXISTS tStations"); dropErr != nil {
+			log.Debug("Cannot drop tStations: ", dropErr)
+		}
+		return err
+	}
+
+	for i, stmt := range m.Queries {
+		stmt = strings.TrimSuffix(strings.TrimSpace(stmt), ";")
+		log.Trace("QUERY: ", stmt)
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			log.Debug("Failed statement of ", m.Id, ": ", stmt)
+			return fail(&SeedStatementError{Migration: m.Id, Index: i + 1, Statement: stmt, Err: err})
+		}
+	}
+
+	var query string
+	var args []interface{}
+	if dir == migrate.Up {
+		query = "INSERT INTO " + seedTable + " (id, applied_at) VALUES (?, ?)"
+		args = []interface{}{m.Id, time.Now()}
+	} else {
+		query = "DELETE FROM " + seedTable + " WHERE id = ?"
+		args = []interface{}{m.Id}
+	}
+	log.Trace("QUERY: ", query)
+	if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+		return fail(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// Check whether a seed migration is applied
+func IsSeedApplied(db *sql.DB, id string) (bool, error) {
+	records, err := seedSet().GetMigrationRecords(db, "mysql")
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if r.Id == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Databases seeded before seeds were tracked per region have a single SEED_MARKET
+// record. Its regions are assumed to be the configured ones: the orders the old seed
+// inserted in them are recorded in seed_orders and their sell order seeds are marked
+// as seeded, so they can be removed and reseeded like any other seed.
+func AdoptLegacySeed(db *sql.DB, dryrun bool) error {
+	applied, err := IsSeedApplied(db, legacySeedID)
+	if err != nil || !applied {
+		return err
+	}
+
+	log.Warn("The market was seeded by an older version, adopting its orders in the configured regions. Orders in regions that are no longer configured can't be removed with seed -remove.")
+	if dryrun {
+		return nil
+	}
+
+	if err := ensureSeedTables(db); err != nil {
+		return err
+	}
+
+	var areas []*SeedArea
+	var sell []*migrate.Migration
+	for _, region := range viper.GetStringSlice("seed-regions") {
+		area, err := ResolveSeedArea(db, region)
+		if err != nil {
+			return err
+		}
+		areas = append(areas, area)
+		//The old seed only inserted sell orders, only the id is needed to mark them
+		sell = append(sell, &migrate.Migration{Id: area.SeedID()})
+	}
+
+	planned, dbMap, err := planSeedMigrations(db, sell, migrate.Up)
+	if err != nil {
+		return err
+	}
+	for _, m := range planned {
+		//The orders of the old seed are the NPC sell orders with its fixed volume and duration
+		query := fmt.Sprintf(`INSERT IGNORE INTO %s (orderID, seedID, typeID, stationID, bid, volEntered)
+			SELECT m.orderID, ?, m.typeID, m.stationID, m.bid, m.volEntered FROM mktOrders m INNER JOIN staStations st ON st.stationID = m.stationID
+			WHERE st.%s AND m.bid = 0 AND m.ownerID = st.corporationID
+			AND m.volEntered = 550 AND m.minVolume = 1 AND m.duration = 250 AND m.jumps = 1`, seedOrdersTable, areaOf(areas, m.Id).StationFilter())
+		log.Trace("QUERY: ", query)
+		if _, err := execWithRetry(db, query, m.Id); err != nil {
+			return fmt.Errorf("Cannot record the orders of %s: %s", m.Id, err)
+		}
+
+		entry := NewHistoryEntry("seed", "up", "seed", m.Id)
+		err := skipPlannedMigration(dbMap, m)
+		entry.Finish(err)
+		RecordHistory(db, entry)
+		if err != nil {
+			return fmt.Errorf("Cannot mark %s as seeded: %s", m.Id, err)
+		}
+	}
+
+	query := "DELETE FROM " + seedTable + " WHERE id = ?"
+	log.Trace("QUERY: ", query)
+	if _, err := execWithRetry(db, query, legacySeedID); err != nil {
+		return fmt.Errorf("Cannot remove the %s record: %s", legacySeedID, err)
+	}
+	return nil
+}
+
+func areaOf(areas []*SeedArea, id string) *SeedArea {
+	for _, area := range areas {
+		if area.SeedID() == id {
+			return area
+		}
+	}
+	return nil
+}
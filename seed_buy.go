@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+// Prefix of the ids of buy order seed migrations
+const buySeedPrefix = "SEED_BUY"
+
+func buySeedID(suffix string) string {
+	return buySeedPrefix + "_" + suffix
+}
+
+// NPC buy orders, configured under seed-buy-orders: in evedb.yaml
+type BuyOrderConfig struct {
+	Enabled    bool    `mapstructure:"enabled"`
+	Saturation int     `mapstructure:"saturation"` // Percentage of the stations of an area with buy orders
+	MinVolume  int     `mapstructure:"min-volume"`
+	MaxVolume  int     `mapstructure:"max-volume"`
+	Discount   float64 `mapstructure:"discount"` // Fraction below the sell price the orders buy at
+	Range      int     `mapstructure:"range"`    // -1 station, 0 solar system, 1-40 jumps, 32767 region
+	Duration   int     `mapstructure:"duration"`
+}
+
+// Get the buy order configuration, filling in defaults for anything not configured
+func GetBuyOrderConfig() (BuyOrderConfig, error) {
+	config := BuyOrderConfig{
+		Saturation: 50,
+		MinVolume:  100,
+		MaxVolume:  1000,
+		Discount:   0.2,
+		Range:      -1,
+		Duration:   90,
+	}
+
+	if viper.IsSet("seed-buy-orders") {
+		if err := unmarshalOverDefaults("seed-buy-orders", &config); err != nil {
+			return config, fmt.Errorf("Invalid seed-buy-orders configuration: %s", err)
+		}
+	}
+
+	if config.Saturation < 0 || config.Saturation > 100 {
+		return config, fmt.Errorf("Invalid seed-buy-orders: saturation must be between 0 and 100")
+	}
+	if config.MinVolume < 1 || config.MaxVolume < config.MinVolume {
+		return config, fmt.Errorf("Invalid seed-buy-orders: need 1 <= min-volume <= max-volume")
+	}
+	if config.Discount < 0 || config.Discount >= 1 {
+		return config, fmt.Errorf("Invalid seed-buy-orders: discount must be at least 0 and below 1")
+	}
+	if config.Duration < 1 {
+		return config, fmt.Errorf("Invalid seed-buy-orders: duration must be positive")
+	}
+
+	return config, nil
+}
+
+// Build the buy order seed migration of an area for the types of its profile. The orders are
+// priced by the pricing model less the configured discount, and tracked apart from sell orders.
+func BuildBuyOrderMigration(db *sql.DB, area *SeedArea, profile *SeedProfile, config BuyOrderConfig, rngSeed int64) (*migrate.Migration, error) {
+	pricing, err := GetPricingModel()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]string{
+		"base_price":  pricing.BaseExpression(),
+		"price":       fmt.Sprintf("ROUND(%s * %s, 2)", pricing.PriceExpression("basePrice", "roll"), formatFloat(1-config.Discount)),
+		"price_join":  pricing.JoinClause(),
+		"min_volume":  strconv.Itoa(config.MinVolume),
+		"volume_span": strconv.Itoa(config.MaxVolume - config.MinVolume + 1),
+		"range":       strconv.Itoa(config.Range),
+		"duration":    strconv.Itoa(config.Duration),
+		"type_filter": profile.TypeCondition,
+	}
+
+	return buildSeedMigration(db, area.BuySeedID(), area, profile, config.Saturation, rngSeed, seedBuyStatements, vars)
+}
+
+// The random volume of an order is hashed from its station and type once in the derived
+// table, it is both the volume entered and the volume remaining of a new order
+var seedBuyStatements = []string{
+	`INSERT INTO mktOrders (typeID, ownerID, regionID, stationID, orderRange, bid, price, volEntered, volRemaining, issued, minVolume, duration, solarSystemID, jumps)
+	SELECT typeID, corporationID, regionID, stationID, ${range}, 1, ${price}, volume, volume, ${timestamp}, 1, ${duration}, solarSystemID, 1
+	FROM (SELECT invTypes.typeID, corporationID, regionID, tStations.stationID, solarSystemID, ${base_price} AS basePrice, ${roll} AS roll,
+			${min_volume} + FLOOR(${volume_roll} * ${volume_span}) AS volume
+		FROM tStations, invTypes INNER JOIN invGroups USING (groupID) ${price_join}
+		WHERE ${type_filter}) AS seedRows
+	ORDER BY stationID, typeID`,
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"gopkg.in/jcmturner/rpc.v1/mstypes"
+)
+
+// Prefix of the ids of seed migrations importing a price file
+const importSeedPrefix = "SEED_IMPORT"
+
+// Number of orders inserted per statement
+const importBatchSize = 500
+
+var importNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// An order read from a price file. Orders without a station are placed at every
+// station of their region, or of the area given on the command line.
+type ImportedOrder struct {
+	TypeID    int     `json:"typeID"`
+	Price     float64 `json:"price"`
+	Volume    int     `json:"volume"`
+	Region    string  `json:"region"`
+	StationID int     `json:"stationID"`
+
+	line int
+}
+
+// Longest seed id, as stored in seed_orders and seed_runs
+const maxSeedIDLength = 64
+
+// Id of the seed migration importing a file, derived from its name including the
+// extension so the orders can be removed by name
+func importSeedID(file string) (string, error) {
+	name := strings.ToUpper(strings.Trim(importNameInvalid.ReplaceAllString(filepath.Base(file), "_"), "_"))
+	if name == "" {
+		return "", fmt.Errorf("Cannot name the seed of %s, its file name needs letters or digits", file)
+	}
+	id := importSeedPrefix + "_" + name
+	if len(id) > maxSeedIDLength {
+		return "", fmt.Errorf("The file name of %s is too long to name its seed, use at most %d characters", file, maxSeedIDLength-len(importSeedPrefix)-1)
+	}
+	return id, nil
+}
+
+// Read orders from a CSV file with a header line, or a JSON array of orders.
+// The columns are typeID, price, volume and optionally region and stationID.
+func ReadPriceFile(file string) ([]ImportedOrder, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var orders []ImportedOrder
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		if err := json.NewDecoder(f).Decode(&orders); err != nil {
+			return nil, fmt.Errorf("Cannot parse %s: %s", file, err)
+		}
+		for i := range orders {
+			orders[i].line = i + 1
+		}
+	} else {
+		if orders, err = readPriceCSV(f); err != nil {
+			return nil, fmt.Errorf("Cannot parse %s: %s", file, err)
+		}
+	}
+
+	for _, o := range orders {
+		if o.TypeID <= 0 || o.Price <= 0 || o.Volume <= 0 {
+			return nil, fmt.Errorf("%s, order %d: typeID, price and volume must be positive", file, o.line)
+		}
+	}
+	return orders, nil
+}
+
+func readPriceCSV(r io.Reader) ([]ImportedOrder, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"typeid", "price", "volume"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("Missing column %s, the header needs typeID, price and volume", required)
+		}
+	}
+
+	var orders []ImportedOrder
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line++
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		o := ImportedOrder{Region: field("region"), line: line}
+		if o.TypeID, err = strconv.Atoi(field("typeid")); err != nil {
+			return nil, fmt.Errorf("Line %d: invalid typeID %q", line, field("typeid"))
+		}
+		if o.Price, err = strconv.ParseFloat(field("price"), 64); err != nil {
+			return nil, fmt.Errorf("Line %d: invalid price %q", line, field("price"))
+		}
+		if o.Volume, err = strconv.Atoi(field("volume")); err != nil {
+			return nil, fmt.Errorf("Line %d: invalid volume %q", line, field("volume"))
+		}
+		if station := field("stationid"); station != "" {
+			if o.StationID, err = strconv.Atoi(station); err != nil {
+				return nil, fmt.Errorf("Line %d: invalid stationID %q", line, station)
+			}
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+// A station orders are placed at
+type importStation struct {
+	StationID     int
+	SolarSystemID int
+	RegionID      int
+	CorporationID int
+}
+
+// Build the seed migration inserting the orders of a price file. Type and station ids
+// are checked against the database, and orders without a station or region are placed
+// in the default area.
+func BuildImportMigration(db *sql.DB, file string, orders []ImportedOrder, defaultArea string, duration int) (*migrate.Migration, error) {
+	if err := checkImportedTypes(db, orders); err != nil {
+		return nil, err
+	}
+
+	stations := make(map[int]importStation)
+	areas := make(map[string][]importStation)
+
+	//Generate a Microsoft timestamp
+	tstamp := mstypes.GetFileTime(time.Now()).MSEpoch()
+
+	var rows []string
+	for _, o := range orders {
+		var targets []importStation
+		if o.StationID != 0 {
+			station, ok := stations[o.StationID]
+			if !ok {
+				var err error
+				if station, err = findImportStation(db, o.StationID); err != nil {
+					return nil, fmt.Errorf("Order %d: %s", o.line, err)
+				}
+				stations[o.StationID] = station
+			}
+			targets = []importStation{station}
+		} else {
+			area := o.Region
+			if area == "" {
+				area = defaultArea
+			}
+			if area == "" {
+				return nil, fmt.Errorf("Order %d has no stationID or region, use -region to place it", o.line)
+			}
+			if _, ok := areas[area]; !ok {
+				list, err := findAreaStations(db, area)
+				if err != nil {
+					return nil, fmt.Errorf("Order %d: %s", o.line, err)
+				}
+				areas[area] = list
+			}
+			targets = areas[area]
+		}
+
+		for _, s := range targets {
+			rows = append(rows, fmt.Sprintf("(%d, %d, %d, %d, %s, %d, %d, %d, 1, %d, %d, 1)",
+				o.TypeID, s.CorporationID, s.RegionID, s.StationID, formatFloat(o.Price), o.Volume, o.Volume, tstamp, duration, s.SolarSystemID))
+		}
+	}
+
+	id, err := importSeedID(file)
+	if err != nil {
+		return nil, err
+	}
+	up := []string{"SELECT COALESCE(MAX(orderID), 0) INTO @lastorder FROM mktOrders"}
+	for start := 0; start < len(rows); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		up = append(up, "INSERT INTO mktOrders (typeID, ownerID, regionID, stationID, price, volEntered, volRemaining, issued, minVolume, duration, solarSystemID, jumps) VALUES "+strings.Join(rows[start:end], ", "))
+	}
+	up = append(up, fmt.Sprintf("INSERT INTO %s (orderID, seedID, typeID, stationID, bid, volEntered) SELECT orderID, '%s', typeID, stationID, bid, volEntered FROM mktOrders WHERE orderID > @lastorder AND issued=%d", seedOrdersTable, id, tstamp))
+
+	var down []string
+	for _, stmt := range seedDownStatements {
+		expanded, err := ExpandVarsWith(stmt, map[string]string{"seed_id": id})
+		if err != nil {
+			return nil, err
+		}
+		down = append(down, expanded)
+	}
+
+	log.Debug("Built migration ", id, " with ", len(rows), " orders")
+	return &migrate.Migration{
+		Id:   id,
+		Up:   up,
+		Down: down,
+	}, nil
+}
+
+// Check that every imported type exists in invTypes
+func checkImportedTypes(db *sql.DB, orders []ImportedOrder) error {
+	known := make(map[int]bool)
+	var ids []int
+	seen := make(map[int]bool)
+	for _, o := range orders {
+		if !seen[o.TypeID] {
+			seen[o.TypeID] = true
+			ids = append(ids, o.TypeID)
+		}
+	}
+
+	for start := 0; start < len(ids); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		query := fmt.Sprintf("SELECT typeID FROM invTypes WHERE typeID IN (%s)", joinInts(ids[start:end]))
+		log.Trace("QUERY: ", query)
+		rows, err := db.Query(query)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			known[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	var unknown []string
+	for _, o := range orders {
+		if !known[o.TypeID] {
+			unknown = append(unknown, fmt.Sprintf("%d (order %d)", o.TypeID, o.line))
+		}
+	}
+	if len(unknown) > 0 {
+		if len(unknown) > 10 {
+			unknown = append(unknown[:10], fmt.Sprintf("and %d more", len(unknown)-10))
+		}
+		return fmt.Errorf("Unknown typeIDs: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+func findImportStation(db *sql.DB, stationID int) (importStation, error) {
+	query := "SELECT stationID, solarSystemID, regionID, corporationID FROM staStations WHERE stationID = ?"
+	log.Trace("QUERY: ", query)
+
+	var s importStation
+	err := db.QueryRow(query, stationID).Scan(&s.StationID, &s.SolarSystemID, &s.RegionID, &s.CorporationID)
+	if err == sql.ErrNoRows {
+		return s, fmt.Errorf("Unknown stationID %d", stationID)
+	}
+	return s, err
+}
+
+func findAreaStations(db *sql.DB, value string) ([]importStation, error) {
+	area, err := ResolveSeedArea(db, value)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT stationID, solarSystemID, regionID, corporationID FROM staStations WHERE " + area.StationFilter()
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stations []importStation
+	for rows.Next() {
+		var s importStation
+		if err := rows.Scan(&s.StationID, &s.SolarSystemID, &s.RegionID, &s.CorporationID); err != nil {
+			return nil, err
+		}
+		stations = append(stations, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(stations) == 0 {
+		return nil, fmt.Errorf("%s has no stations", area.Name)
+	}
+	return stations, nil
+}
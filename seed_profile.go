@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Attribute holding the meta level of a type in dgmTypeAttributes
+const metaLevelAttribute = 633
+
+// What to seed in an area. Profiles are configured under seed-profiles: and assigned
+// to areas under seed-region-profiles:, anything not set comes from the default profile.
+type SeedProfile struct {
+	Name string `mapstructure:"-"`
+
+	// Percentage of the stations of an area that are seeded, seed-saturation when not set.
+	// 0 only seeds the included stations.
+	Saturation int `mapstructure:"saturation"`
+
+	// A type is seeded if it matches any include list, or all types if they are all
+	// empty, and it matches no exclude list
+	IncludeCategories   []int `mapstructure:"include-categories"`
+	ExcludeCategories   []int `mapstructure:"exclude-categories"`
+	IncludeGroups       []int `mapstructure:"include-groups"`
+	ExcludeGroups       []int `mapstructure:"exclude-groups"`
+	IncludeMarketGroups []int `mapstructure:"include-market-groups"` // Including their sub groups
+	ExcludeMarketGroups []int `mapstructure:"exclude-market-groups"`
+	IncludeTypes        []int `mapstructure:"include-types"`
+	ExcludeTypes        []int `mapstructure:"exclude-types"`
+
+	// Meta groups to leave out, e.g. 3 storyline, 4 faction, 5 officer, 6 deadspace
+	ExcludeMetaGroups []int `mapstructure:"exclude-meta-groups"`
+	// Highest meta level seeded, -1 for no limit
+	MaxMetaLevel int `mapstructure:"max-meta-level"`
+
+	// Stations seeded in an area, the saturation applies to the stations matching all filters
+	MinSecurity       float64 `mapstructure:"min-security"`
+	MaxSecurity       float64 `mapstructure:"max-security"`
+	OwnerCorporations []int   `mapstructure:"owner-corporations"`
+	OwnerFactions     []int   `mapstructure:"owner-factions"`
+	Operations        []int   `mapstructure:"operations"`
+	Services          []int   `mapstructure:"services"`         // Stations must offer all of them
+	IncludeStations   []int   `mapstructure:"include-stations"` // Always seeded, e.g. trade hubs
+	ExcludeStations   []int   `mapstructure:"exclude-stations"` // Never seeded, even when included
+
+	// SQL condition on invTypes and invGroups selecting the seeded types
+	TypeCondition string `mapstructure:"-"`
+	// SQL condition on staStations selecting the sampled stations
+	StationCondition string `mapstructure:"-"`
+}
+
+func defaultSeedProfile() SeedProfile {
+	return SeedProfile{
+		Name:              "default",
+		IncludeCategories: []int{4, 5, 6, 7, 8, 9, 16, 17, 18, 22, 23, 24, 25, 32, 34, 35, 39, 40, 41, 42, 43, 46},
+		MaxMetaLevel:      -1,
+		MinSecurity:       -1,
+		MaxSecurity:       1,
+	}
+}
+
+// Get the name of the profile assigned to an area by its configured name, its map name or its id
+func seedProfileName(value string, area *SeedArea) string {
+	assigned := viper.GetStringMapString("seed-region-profiles")
+	for _, key := range []string{value, area.Name, strconv.Itoa(area.ID)} {
+		//Viper keys are lower case
+		if name, ok := assigned[strings.ToLower(key)]; ok {
+			return name
+		}
+	}
+	return "default"
+}
+
+// Load the seed profile of an area
+func LoadSeedProfile(db *sql.DB, value string, area *SeedArea) (*SeedProfile, error) {
+	profile := defaultSeedProfile()
+
+	saturationSet := viper.IsSet("seed-profiles.default.saturation")
+
+	//A configured default profile changes the defaults of all other profiles
+	if viper.IsSet("seed-profiles.default") {
+		if err := unmarshalOverDefaults("seed-profiles.default", &profile); err != nil {
+			return nil, fmt.Errorf("Invalid seed profile default: %s", err)
+		}
+	}
+
+	name := seedProfileName(value, area)
+	if name != "default" {
+		key := "seed-profiles." + strings.ToLower(name)
+		if !viper.IsSet(key) {
+			return nil, fmt.Errorf("Unknown seed profile %s for %s", name, value)
+		}
+		if err := unmarshalOverDefaults(key, &profile); err != nil {
+			return nil, fmt.Errorf("Invalid seed profile %s: %s", name, err)
+		}
+		saturationSet = saturationSet || viper.IsSet(key+".saturation")
+	}
+	profile.Name = name
+
+	if !saturationSet {
+		profile.Saturation = viper.GetInt("seed-saturation")
+	}
+	if profile.Saturation < 0 || profile.Saturation > 100 {
+		return nil, fmt.Errorf("Invalid seed profile %s: saturation must be between 0 and 100", name)
+	}
+
+	if profile.MinSecurity > profile.MaxSecurity {
+		return nil, fmt.Errorf("Invalid seed profile %s: min-security is above max-security", name)
+	}
+
+	condition, err := profile.typeCondition(db)
+	if err != nil {
+		return nil, err
+	}
+	profile.TypeCondition = condition
+	profile.StationCondition = profile.stationCondition()
+
+	return &profile, nil
+}
+
+func (p *SeedProfile) typeCondition(db *sql.DB) (string, error) {
+	includeMarketGroups, err := expandMarketGroups(db, p.IncludeMarketGroups)
+	if err != nil {
+		return "", err
+	}
+	excludeMarketGroups, err := expandMarketGroups(db, p.ExcludeMarketGroups)
+	if err != nil {
+		return "", err
+	}
+
+	conditions := []string{"invTypes.published = 1"}
+
+	var includes []string
+	includes = appendInCondition(includes, "invGroups.categoryID", p.IncludeCategories)
+	includes = appendInCondition(includes, "invTypes.groupID", p.IncludeGroups)
+	includes = appendInCondition(includes, "invTypes.marketGroupID", includeMarketGroups)
+	includes = appendInCondition(includes, "invTypes.typeID", p.IncludeTypes)
+	if len(includes) > 0 {
+		conditions = append(conditions, "("+strings.Join(includes, " OR ")+")")
+	}
+
+	var excludes []string
+	excludes = appendInCondition(excludes, "invGroups.categoryID", p.ExcludeCategories)
+	excludes = appendInCondition(excludes, "invTypes.groupID", p.ExcludeGroups)
+	excludes = appendInCondition(excludes, "invTypes.marketGroupID", excludeMarketGroups)
+	excludes = appendInCondition(excludes, "invTypes.typeID", p.ExcludeTypes)
+	for _, exclude := range excludes {
+		conditions = append(conditions, "NOT "+exclude)
+	}
+
+	if len(p.ExcludeMetaGroups) > 0 {
+		conditions = append(conditions, fmt.Sprintf("invTypes.typeID NOT IN (SELECT typeID FROM invMetaTypes WHERE metaGroupID IN (%s))", joinInts(p.ExcludeMetaGroups)))
+	}
+	if p.MaxMetaLevel >= 0 {
+		conditions = append(conditions, fmt.Sprintf("NOT EXISTS (SELECT 1 FROM dgmTypeAttributes WHERE dgmTypeAttributes.typeID = invTypes.typeID AND attributeID = %d AND COALESCE(valueInt, valueFloat) > %d)", metaLevelAttribute, p.MaxMetaLevel))
+	}
+
+	return strings.Join(conditions, " AND "), nil
+}
+
+func (p *SeedProfile) stationCondition() string {
+	var conditions []string
+	if p.MinSecurity > -1 {
+		conditions = append(conditions, "security >= "+formatFloat(p.MinSecurity))
+	}
+	if p.MaxSecurity < 1 {
+		conditions = append(conditions, "security <= "+formatFloat(p.MaxSecurity))
+	}
+	conditions = appendInCondition(conditions, "corporationID", p.OwnerCorporations)
+	if len(p.OwnerFactions) > 0 {
+		conditions = append(conditions, fmt.Sprintf("corporationID IN (SELECT corporationID FROM crpNPCCorporations WHERE factionID IN (%s))", joinInts(p.OwnerFactions)))
+	}
+	conditions = appendInCondition(conditions, "operationID", p.Operations)
+	for _, service := range p.Services {
+		conditions = append(conditions, fmt.Sprintf("operationID IN (SELECT operationID FROM staOperationServices WHERE serviceID = %d)", service))
+	}
+	//Included stations are added after sampling
+	for _, ids := range [][]int{p.IncludeStations, p.ExcludeStations} {
+		if len(ids) > 0 {
+			conditions = append(conditions, fmt.Sprintf("stationID NOT IN (%s)", joinInts(ids)))
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func appendInCondition(conditions []string, column string, ids []int) []string {
+	if len(ids) == 0 {
+		return conditions
+	}
+	return append(conditions, fmt.Sprintf("%s IN (%s)", column, joinInts(ids)))
+}
+
+func joinInts(ids []int) string {
+	var parts []string
+	for _, id := range ids {
+		parts = append(parts, strconv.Itoa(id))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Add the sub groups of market groups, which form a tree in invMarketGroups
+func expandMarketGroups(db *sql.DB, ids []int) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	query := "SELECT marketGroupID, parentGroupID FROM invMarketGroups WHERE parentGroupID IS NOT NULL"
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read market groups: %s", err)
+	}
+	defer rows.Close()
+
+	children := make(map[int][]int)
+	for rows.Next() {
+		var id, parent int
+		if err := rows.Scan(&id, &parent); err != nil {
+			return nil, err
+		}
+		children[parent] = append(children[parent], id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool)
+	var result []int
+	pending := append([]int{}, ids...)
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+		pending = append(pending, children[id]...)
+	}
+	return result, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// Summary of the orders a seed migration inserted
+type SeedReport struct {
+	Area        string           `json:"area"`
+	SeedID      string           `json:"seedID"`
+	Stations    int              `json:"stations"`
+	Orders      int              `json:"orders"`
+	MinPrice    float64          `json:"minPrice"`
+	MedianPrice float64          `json:"medianPrice"`
+	MaxPrice    float64          `json:"maxPrice"`
+	TotalISK    float64          `json:"totalISK"` // Price times remaining volume of all orders
+	Categories  []CategoryOrders `json:"categories"`
+}
+
+// Number of seeded orders of an item category
+type CategoryOrders struct {
+	CategoryID   int    `json:"categoryID"`
+	CategoryName string `json:"categoryName"`
+	Orders       int    `json:"orders"`
+}
+
+// Build the reports of applied seed migrations from the orders they recorded in seed_orders.
+// Areas maps seed ids to the configured area they were built for.
+func BuildSeedReports(db *sql.DB, ids []string, areas map[string]string) ([]SeedReport, error) {
+	var reports []SeedReport
+	for _, id := range ids {
+		report, err := buildSeedReport(db, id)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot build the report of %s: %s", id, err)
+		}
+		report.Area = areas[id]
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func buildSeedReport(db *sql.DB, id string) (SeedReport, error) {
+	report := SeedReport{SeedID: id, Categories: []CategoryOrders{}}
+
+	query := "SELECT COUNT(DISTINCT m.stationID), COALESCE(SUM(m.price * m.volRemaining), 0) FROM mktOrders m INNER JOIN " + seedOrdersTable + " so USING (orderID) WHERE so.seedID = ?"
+	log.Trace("QUERY: ", query)
+	if err := db.QueryRow(query, id).Scan(&report.Stations, &report.TotalISK); err != nil {
+		return report, err
+	}
+
+	query = "SELECT m.price FROM mktOrders m INNER JOIN " + seedOrdersTable + " so USING (orderID) WHERE so.seedID = ? ORDER BY m.price"
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query, id)
+	if err != nil {
+		return report, err
+	}
+	var prices []float64
+	for rows.Next() {
+		var price float64
+		if err := rows.Scan(&price); err != nil {
+			rows.Close()
+			return report, err
+		}
+		prices = append(prices, price)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	report.Orders = len(prices)
+	if n := len(prices); n > 0 {
+		report.MinPrice = prices[0]
+		report.MaxPrice = prices[n-1]
+		if n%2 == 1 {
+			report.MedianPrice = prices[n/2]
+		} else {
+			report.MedianPrice = (prices[n/2-1] + prices[n/2]) / 2
+		}
+	}
+
+	query = `SELECT invCategories.categoryID, invCategories.categoryName, COUNT(*)
+		FROM mktOrders m INNER JOIN ` + seedOrdersTable + ` so USING (orderID)
+		INNER JOIN invTypes ON invTypes.typeID = m.typeID
+		INNER JOIN invGroups ON invGroups.groupID = invTypes.groupID
+		INNER JOIN invCategories ON invCategories.categoryID = invGroups.categoryID
+		WHERE so.seedID = ?
+		GROUP BY invCategories.categoryID, invCategories.categoryName
+		ORDER BY COUNT(*) DESC, invCategories.categoryName`
+	log.Trace("QUERY: ", query)
+	rows, err = db.Query(query, id)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c CategoryOrders
+		if err := rows.Scan(&c.CategoryID, &c.CategoryName, &c.Orders); err != nil {
+			return report, err
+		}
+		report.Categories = append(report.Categories, c)
+	}
+	return report, rows.Err()
+}
+
+// Print the seed reports as a table per seed and a table of the orders per category
+func PrintSeedReports(reports []SeedReport) {
+	var rows [][]string
+	var categories [][]string
+	for _, r := range reports {
+		rows = append(rows, []string{
+			r.Area,
+			r.SeedID,
+			strconv.Itoa(r.Stations),
+			strconv.Itoa(r.Orders),
+			strconv.FormatFloat(r.MinPrice, 'f', 2, 64),
+			strconv.FormatFloat(r.MedianPrice, 'f', 2, 64),
+			strconv.FormatFloat(r.MaxPrice, 'f', 2, 64),
+			strconv.FormatFloat(r.TotalISK, 'f', 2, 64),
+		})
+		for _, c := range r.Categories {
+			categories = append(categories, []string{r.SeedID, c.CategoryName, strconv.Itoa(c.Orders)})
+		}
+	}
+
+	PrintTable([]string{"Area", "Seed", "Stations", "Orders", "Min price", "Median price", "Max price", "Total ISK"}, rows)
+	if len(categories) > 0 {
+		PrintTable([]string{"Seed", "Category", "Orders"}, categories)
+	}
+}
+
+// Write the seed reports to a JSON file
+func WriteSeedReports(file string, reports []SeedReport) error {
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		return fmt.Errorf("Cannot write the seed report: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/jcmturner/rpc.v1/mstypes"
+)
+
+// Orders of area seeds, which can be recreated and repriced from the seed configuration.
+// Imported orders are only topped up, their prices come from the imported file.
+const areaSeedCondition = `(so.seedID LIKE 'SEED\_MARKET\_%' OR so.seedID LIKE 'SEED\_BUY\_%')`
+
+// Replenishment of seeded orders, configured under seed-watch: in evedb.yaml
+type WatchConfig struct {
+	Interval  time.Duration
+	Threshold float64 // Top up orders whose remaining volume fell below this fraction
+	Reprice   bool    // Also reprice all seeded orders on every pass
+}
+
+func GetWatchConfig() WatchConfig {
+	config := WatchConfig{
+		Interval:  10 * time.Minute,
+		Threshold: 0.5,
+	}
+
+	if viper.IsSet("seed-watch.interval") {
+		config.Interval = viper.GetDuration("seed-watch.interval")
+	}
+	if viper.IsSet("seed-watch.threshold") {
+		config.Threshold = viper.GetFloat64("seed-watch.threshold")
+	}
+	if viper.IsSet("seed-watch.reprice") {
+		config.Reprice = viper.GetBool("seed-watch.reprice")
+	}
+
+	return config
+}
+
+// What a replenishment pass changed
+type WatchResult struct {
+	ToppedUp  int64
+	Recreated int64
+	Repriced  int64
+}
+
+// Top up seeded orders below the threshold, recreate the seeded orders that were consumed
+// and optionally reprice them, all in one transaction
+func ReplenishSeeds(db *sql.DB, config WatchConfig) (WatchResult, error) {
+	var result WatchResult
+
+	if err := ensureSeedTables(db); err != nil {
+		return result, err
+	}
+
+	pricing, err := GetPricingModel()
+	if err != nil {
+		return result, err
+	}
+	buy, err := GetBuyOrderConfig()
+	if err != nil {
+		return result, err
+	}
+
+	//Orders are priced from a derived table, which draws the random number of each order once
+	sellPrice := pricing.PriceExpression("seedRows.basePrice", "seedRows.roll")
+	price := fmt.Sprintf("IF(seedRows.bid = 1, ROUND(%s * %s, 2), %s)", sellPrice, formatFloat(1-buy.Discount), sellPrice)
+	//Generate a Microsoft timestamp
+	tstamp := mstypes.GetFileTime(time.Now()).MSEpoch()
+
+	topUp := fmt.Sprintf(`UPDATE mktOrders m INNER JOIN %s so USING (orderID)
+		SET m.volRemaining = so.volEntered
+		WHERE m.volRemaining < so.volEntered * %s`, seedOrdersTable, formatFloat(config.Threshold))
+
+	//Tracked orders that are gone from the market, with everything needed to recreate them
+	consumed := fmt.Sprintf(`SELECT orderID, typeID, corporationID, regionID, stationID, bid, IF(bid = 1, %d, -1), %s, volEntered, IF(bid = 1, %d, 250), solarSystemID
+		FROM (SELECT so.orderID, so.typeID, st.corporationID, st.regionID, so.stationID, so.bid, so.volEntered, st.solarSystemID, %s AS basePrice, RAND() AS roll
+			FROM %s so
+			INNER JOIN staStations st ON st.stationID = so.stationID
+			INNER JOIN invTypes ON invTypes.typeID = so.typeID
+			INNER JOIN invGroups ON invGroups.groupID = invTypes.groupID %s
+			LEFT JOIN mktOrders m ON m.orderID = so.orderID
+			WHERE m.orderID IS NULL AND %s) AS seedRows
+		ORDER BY orderID`,
+		buy.Range, price, buy.Duration, pricing.BaseExpression(), seedOrdersTable, pricing.JoinClause(), areaSeedCondition)
+
+	reprice := fmt.Sprintf(`UPDATE mktOrders m INNER JOIN (SELECT so.orderID, so.bid, %s AS basePrice, RAND() AS roll
+			FROM %s so
+			INNER JOIN staStations st ON st.stationID = so.stationID
+			INNER JOIN invTypes ON invTypes.typeID = so.typeID
+			INNER JOIN invGroups ON invGroups.groupID = invTypes.groupID %s
+			WHERE %s) AS seedRows USING (orderID)
+		SET m.price = %s`, pricing.BaseExpression(), seedOrdersTable, pricing.JoinClause(), areaSeedCondition, price)
+
+	err = GetRetryPolicy().Do("Replenishing seeded orders", func() error {
+		result = WatchResult{}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		fail := func(err error) error {
+			_ = tx.Rollback()
+			return err
+		}
+
+		exec := func(query string) (int64, error) {
+			log.Trace("QUERY: ", query)
+			res, err := tx.Exec(query)
+			if err != nil {
+				return 0, err
+			}
+			return res.RowsAffected()
+		}
+
+		if result.ToppedUp, err = exec(topUp); err != nil {
+			return fail(err)
+		}
+		if result.Recreated, err = recreateOrders(tx, consumed, tstamp); err != nil {
+			return fail(err)
+		}
+		if config.Reprice {
+			if result.Repriced, err = exec(reprice); err != nil {
+				return fail(err)
+			}
+		}
+
+		return tx.Commit()
+	})
+
+	return result, err
+}
+
+// A tracked order that was consumed, as it is recreated
+type consumedOrder struct {
+	OrderID       int64
+	TypeID        int
+	OwnerID       int
+	RegionID      int
+	StationID     int
+	Bid           int
+	Range         int
+	Price         float64
+	Volume        int
+	Duration      int
+	SolarSystemID int
+}
+
+// Recreate the consumed orders one by one and point each tracking row to the order
+// that replaced it, so every tracked order keeps exactly one order in the market
+func recreateOrders(tx *sql.Tx, consumed string, tstamp int64) (int64, error) {
+	log.Trace("QUERY: ", consumed)
+	rows, err := tx.Query(consumed)
+	if err != nil {
+		return 0, err
+	}
+	var orders []consumedOrder
+	for rows.Next() {
+		var o consumedOrder
+		if err := rows.Scan(&o.OrderID, &o.TypeID, &o.OwnerID, &o.RegionID, &o.StationID, &o.Bid, &o.Range, &o.Price, &o.Volume, &o.Duration, &o.SolarSystemID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		orders = append(orders, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	insert := `INSERT INTO mktOrders (typeID, ownerID, regionID, stationID, bid, orderRange, price, volEntered, volRemaining, issued, minVolume, duration, solarSystemID, jumps)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1, ?, ?, 1)`
+	remap := "UPDATE " + seedOrdersTable + " SET orderID = ? WHERE orderID = ?"
+	log.Trace("QUERY: ", insert)
+	log.Trace("QUERY: ", remap)
+
+	var n int64
+	for _, o := range orders {
+		res, err := tx.Exec(insert, o.TypeID, o.OwnerID, o.RegionID, o.StationID, o.Bid, o.Range, o.Price, o.Volume, o.Volume, tstamp, o.Duration, o.SolarSystemID)
+		if err != nil {
+			return n, err
+		}
+		orderID, err := res.LastInsertId()
+		if err != nil {
+			return n, err
+		}
+		if _, err := tx.Exec(remap, orderID, o.OrderID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
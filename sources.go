@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+// A named directory of migrations, tracked in its own table
+type SourceConfig struct {
+	Name  string `mapstructure:"name"`
+	Dir   string `mapstructure:"dir"`
+	Table string `mapstructure:"table"`
+}
+
+// Migration set used to execute this source against its tracking table
+func (s SourceConfig) Set() migrate.MigrationSet {
+	return migrate.MigrationSet{TableName: s.Table}
+}
+
+// Migration source reading the files of this source.
+// The database is used to keep migrations that are applied but no longer match the environment.
+func (s SourceConfig) Source(db *sql.DB) *FileSource {
+	source := NewFileSource(s.Dir)
+	source.DB = db
+	source.Table = s.Table
+	return source
+}
+
+// Get the configured migration sources in the order they are applied.
+// Without a migration-sources section, migrations-dir is used as the only source.
+func GetMigrationSources() ([]SourceConfig, error) {
+	var sources []SourceConfig
+
+	if !viper.IsSet("migration-sources") {
+		sources = append(sources, SourceConfig{
+			Name:  "evemu",
+			Dir:   viper.GetString("migrations-dir"),
+			Table: "migrations",
+		})
+		return sources, nil
+	}
+
+	if err := viper.UnmarshalKey("migration-sources", &sources); err != nil {
+		return nil, fmt.Errorf("Invalid migration-sources configuration: %s", err)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("No migration sources configured")
+	}
+
+	names := make(map[string]bool)
+	tables := make(map[string]bool)
+	for i := range sources {
+		if sources[i].Name == "" {
+			return nil, fmt.Errorf("Migration source %d has no name", i+1)
+		}
+		if sources[i].Dir == "" {
+			return nil, fmt.Errorf("Migration source %s has no dir", sources[i].Name)
+		}
+		if sources[i].Table == "" {
+			sources[i].Table = sources[i].Name + "_migrations"
+		}
+		if names[sources[i].Name] {
+			return nil, fmt.Errorf("Duplicate migration source name: %s", sources[i].Name)
+		}
+		if tables[sources[i].Table] {
+			return nil, fmt.Errorf("Migration sources share the tracking table %s", sources[i].Table)
+		}
+		names[sources[i].Name] = true
+		tables[sources[i].Table] = true
+	}
+
+	return sources, nil
+}
+
+// Get the configured migration sources, limited to the named one if given
+func SelectMigrationSources(name string) ([]SourceConfig, error) {
+	sources, err := GetMigrationSources()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return sources, nil
+	}
+
+	for _, s := range sources {
+		if s.Name == name {
+			return []SourceConfig{s}, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown migration source: %s", name)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+)
+
+// Split an SQL script into statements, honouring the mysql client's DELIMITER
+// command so procedure, function and trigger bodies can contain semicolons.
+func SplitStatements(script string) ([]string, error) {
+	delimiter := ";"
+	var statements []string
+	var buf strings.Builder
+	var quote byte //Quote of a string or identifier continuing on the next line
+
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		if buf.Len() == 0 && quote == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "-- ") || trimmed == "--" || strings.HasPrefix(trimmed, "#")) {
+			continue //Skip blank lines and comments between statements
+		}
+
+		if fields := strings.Fields(trimmed); quote == 0 && len(fields) > 0 && strings.EqualFold(fields[0], "DELIMITER") {
+			if buf.Len() > 0 {
+				return nil, fmt.Errorf("DELIMITER changed before the statement ending with %q was terminated", delimiter)
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("Invalid DELIMITER command: %s", trimmed)
+			}
+			delimiter = fields[1]
+			continue
+		}
+
+		//A comment after the delimiter doesn't continue the statement
+		var code string
+		code, quote = stripTrailingComment(line, quote)
+		if quote == 0 && strings.HasSuffix(strings.TrimSpace(code), delimiter) {
+			buf.WriteString(code)
+			buf.WriteString("\n")
+			statement := strings.TrimSpace(buf.String())
+			statement = strings.TrimSpace(strings.TrimSuffix(statement, delimiter))
+			if statement != "" {
+				statements = append(statements, statement)
+			}
+			buf.Reset()
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if rest := strings.TrimSpace(buf.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+
+	return statements, nil
+}
+
+// Cut a line before a trailing -- or # comment outside of quotes. Like in MySQL, --
+// only starts a comment when followed by whitespace or the end of the line. The quote
+// still open at the start and at the end of the line is passed in and returned.
+func stripTrailingComment(line string, quote byte) (string, byte) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != 0 {
+			if c == '\\' && quote != '`' {
+				i++ //Escaped character
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '#':
+			return line[:i], quote
+		case c == '-' && strings.HasPrefix(line[i:], "--") && (i+2 == len(line) || line[i+2] == ' ' || line[i+2] == '\t'):
+			return line[:i], quote
+		}
+	}
+	return line, quote
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			name:   "single statement",
+			script: "SELECT 1;",
+			want:   []string{"SELECT 1"},
+		},
+		{
+			name:   "statements on several lines",
+			script: "SELECT 1\nFROM dual;\nSELECT 2;\n",
+			want:   []string{"SELECT 1\nFROM dual", "SELECT 2"},
+		},
+		{
+			name:   "comments and blank lines between statements",
+			script: "-- first\n\nSELECT 1;\n# second\n--\nSELECT 2;",
+			want:   []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:   "trailing dash comment after the delimiter",
+			script: "SELECT 1; -- one\nSELECT 2;",
+			want:   []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:   "trailing hash comment after the delimiter",
+			script: "SELECT 1; # one\nSELECT 2;",
+			want:   []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:   "comment containing the delimiter",
+			script: "SELECT 1 -- not done;\n+ 1;",
+			want:   []string{"SELECT 1 -- not done;\n+ 1"},
+		},
+		{
+			name:   "hash inside a string",
+			script: "SELECT '#1';\nSELECT 2;",
+			want:   []string{"SELECT '#1'", "SELECT 2"},
+		},
+		{
+			name:   "dashes inside a string",
+			script: "SELECT 'a -- b';\nSELECT 2;",
+			want:   []string{"SELECT 'a -- b'", "SELECT 2"},
+		},
+		{
+			name:   "dashes without whitespace are not a comment",
+			script: "SELECT 1--1;\nSELECT 2;",
+			want:   []string{"SELECT 1--1", "SELECT 2"},
+		},
+		{
+			name:   "escaped quote inside a string",
+			script: "SELECT 'it\\'s # not a comment';\nSELECT `a#b` FROM t; # comment\nSELECT \"x -- y\";",
+			want:   []string{"SELECT 'it\\'s # not a comment'", "SELECT `a#b` FROM t", "SELECT \"x -- y\""},
+		},
+		{
+			name:   "delimiter inside a string spanning lines",
+			script: "INSERT INTO t VALUES ('a;\nb');\nSELECT 2;",
+			want:   []string{"INSERT INTO t VALUES ('a;\nb')", "SELECT 2"},
+		},
+		{
+			name:   "unterminated last statement",
+			script: "SELECT 1;\nSELECT 2",
+			want:   []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:   "custom delimiter",
+			script: "DELIMITER //\nCREATE PROCEDURE p() BEGIN SELECT 1; END // -- done\nDELIMITER ;\nCALL p();",
+			want:   []string{"CREATE PROCEDURE p() BEGIN SELECT 1; END", "CALL p()"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SplitStatements(tt.script)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatementsDelimiterInsideStatement(t *testing.T) {
+	if _, err := SplitStatements("SELECT 1\nDELIMITER //\n"); err == nil {
+		t.Error("expected an error when DELIMITER interrupts a statement")
+	}
+}
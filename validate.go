@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	migrate "github.com/rubenv/sql-migrate"
+	"github.com/spf13/viper"
+)
+
+// Outcome of a single statement executed against the scratch schema
+type validationResult struct {
+	Migration string
+	Statement int
+	Query     string
+	Duration  time.Duration
+	Err       error
+	Skipped   bool
+}
+
+// Execute planned migrations against an empty copy of the live schema and report
+// the outcome of every statement. The scratch schema is always dropped afterwards.
+func ValidateMigrations(db *sql.DB, migrations []*migrate.PlannedMigration) error {
+	if len(migrations) == 0 {
+		ui.Output("Nothing to validate")
+		return nil
+	}
+
+	live := viper.GetString("db-database")
+	scratch := fmt.Sprintf("%s_validate_%d", live, time.Now().Unix())
+
+	log.Info("Cloning schema ", live, " into ", scratch, "...")
+	if err := cloneSchema(db, live, scratch); err != nil {
+		dropSchema(db, scratch)
+		return fmt.Errorf("Cannot create scratch schema: %s", err)
+	}
+	defer dropSchema(db, scratch)
+
+	scratchDB := getDBFor(scratch)
+	defer scratchDB.Close()
+
+	//A single connection keeps session state (variables, temporary tables) between statements
+	scratchDB.SetMaxOpenConns(1)
+
+	var results []validationResult
+	failed := 0
+	for _, m := range migrations {
+		broken := false
+		for i, stmt := range m.Queries {
+			result := validationResult{
+				Migration: m.Id,
+				Statement: i + 1,
+				Query:     stmt,
+			}
+			if broken {
+				result.Skipped = true
+			} else {
+				start := time.Now()
+				_, result.Err = scratchDB.Exec(stmt)
+				result.Duration = time.Since(start)
+				if result.Err != nil {
+					broken = true
+					failed++
+				}
+			}
+			results = append(results, result)
+		}
+	}
+
+	var rows [][]string
+	for _, r := range results {
+		status := "ok"
+		if r.Skipped {
+			status = "skipped"
+		} else if r.Err != nil {
+			status = "FAILED: " + r.Err.Error()
+		}
+		rows = append(rows, []string{
+			r.Migration,
+			fmt.Sprintf("%d", r.Statement),
+			summarizeStatement(r.Query),
+			status,
+			r.Duration.Round(time.Millisecond).String(),
+		})
+	}
+	PrintTable([]string{"Migration", "#", "Statement", "Result", "Time"}, rows)
+
+	if failed > 0 {
+		return fmt.Errorf("Validation failed: %d statements failed", failed)
+	}
+	ui.Output(fmt.Sprintf("Validated %d migrations", len(migrations)))
+	return nil
+}
+
+// Create a new schema with the structure, but none of the data, of an existing one
+func cloneSchema(db *sql.DB, from string, to string) error {
+	query := fmt.Sprintf("CREATE DATABASE `%s`", to)
+	log.Trace("QUERY: ", query)
+	if _, err := db.Exec(query); err != nil {
+		return err
+	}
+
+	query = `SELECT TABLE_NAME, TABLE_TYPE FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = ? ORDER BY TABLE_NAME`
+	log.Trace("QUERY: ", query)
+	rows, err := db.Query(query, from)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	var views []string
+	for rows.Next() {
+		var name, tableType string
+		if err := rows.Scan(&name, &tableType); err != nil {
+			rows.Close()
+			return err
+		}
+		if tableType == "VIEW" {
+			views = append(views, name)
+		} else {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		query := fmt.Sprintf("CREATE TABLE `%s`.`%s` LIKE `%s`.`%s`", to, table, from, table)
+		log.Trace("QUERY: ", query)
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	//Views are recreated on a best effort basis, they may reference other schemas
+	for _, view := range views {
+		var name, definition, charset, collation string
+		query := fmt.Sprintf("SHOW CREATE VIEW `%s`.`%s`", from, view)
+		if err := db.QueryRow(query).Scan(&name, &definition, &charset, &collation); err != nil {
+			log.Warn("Cannot read view ", view, "; ", err)
+			continue
+		}
+		definition = strings.Replace(definition, "`"+from+"`.", "`"+to+"`.", -1)
+		scratchDB := getDBFor(to)
+		if _, err := scratchDB.Exec(definition); err != nil {
+			log.Warn("Cannot clone view ", view, "; ", err)
+		}
+		scratchDB.Close()
+	}
+
+	log.Debug("Cloned ", len(tables), " tables and ", len(views), " views")
+	return nil
+}
+
+func dropSchema(db *sql.DB, name string) {
+	query := fmt.Sprintf("DROP DATABASE IF EXISTS `%s`", name)
+	log.Trace("QUERY: ", query)
+	if _, err := db.Exec(query); err != nil {
+		log.Error("Failed to drop scratch schema ", name, "; ", err)
+	}
+}
+
+// Shorten a statement to a single line for tabular output
+func summarizeStatement(query string) string {
+	summary := strings.Join(strings.Fields(query), " ")
+	if len(summary) > 60 {
+		summary = summary[:57] + "..."
+	}
+	return summary
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Variables given on the command line with -var, these override the vars of evedb.yaml
+var cliVars = make(map[string]string)
+
+var varPattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+
+// Flag collecting repeated -var name=value arguments
+type varFlag struct {
+}
+
+func (f varFlag) String() string {
+	return ""
+}
+
+func (f varFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("Expected name=value, got %q", value)
+	}
+	cliVars[strings.ToLower(strings.TrimSpace(parts[0]))] = parts[1]
+	return nil
+}
+
+// Get all variables available to SQL files. Names are case-insensitive.
+func GetVars() map[string]string {
+	vars := map[string]string{
+		"database": viper.GetString("db-database"),
+	}
+	for name, value := range viper.GetStringMapString("vars") {
+		vars[strings.ToLower(name)] = value
+	}
+	for name, value := range cliVars {
+		vars[name] = value
+	}
+	return vars
+}
+
+// Replace ${name} references in SQL with the configured variables.
+// "$${name}" produces a literal "${name}", and undefined variables are an error.
+func ExpandVars(text string) (string, error) {
+	return ExpandVarsWith(text, nil)
+}
+
+// Like ExpandVars, with additional variables that take precedence over the configured ones
+func ExpandVarsWith(text string, extra map[string]string) (string, error) {
+	if !strings.Contains(text, "${") {
+		return text, nil
+	}
+
+	vars := GetVars()
+	for name, value := range extra {
+		vars[strings.ToLower(name)] = value
+	}
+
+	undefined := make(map[string]bool)
+	result := varPattern.ReplaceAllStringFunc(text, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := strings.ToLower(match[2 : len(match)-1])
+		value, ok := vars[name]
+		if !ok {
+			undefined[name] = true
+			return match
+		}
+		return value
+	})
+
+	if len(undefined) > 0 {
+		var names []string
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("Undefined variables: %s (set them under vars: in evedb.yaml or with -var name=value)", strings.Join(names, ", "))
+	}
+
+	return result, nil
+}
+
+// Expand the variables of statements that are about to run. Comments are stripped
+// first, so a "${" in a comment doesn't have to be a variable.
+func ExpandStatements(statements []string) ([]string, error) {
+	var expanded []string
+	for _, stmt := range statements {
+		var lines []string
+		var quote byte
+		for _, line := range strings.Split(stmt, "\n") {
+			var code string
+			code, quote = stripTrailingComment(line, quote)
+			lines = append(lines, code)
+		}
+		result, err := ExpandVars(strings.Join(lines, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, result)
+	}
+	return expanded, nil
+}